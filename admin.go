@@ -0,0 +1,69 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+type peekRequest struct {
+	address   string
+	count     int
+	replyChan chan []*Message
+}
+
+type purgeRequest struct {
+	address   string
+	replyChan chan int
+}
+
+// Peek returns copies of up to count of the messages queued on address, in
+// the order they would be delivered, without removing them.
+func (exchange *Exchange) Peek(address string, count int) []*Message {
+	replyChan := make(chan []*Message)
+	exchange.shardFor(address).peekChan <- &peekRequest{address, count, replyChan}
+	return <-replyChan
+}
+
+// Purge throws away every message queued on address, without moving them
+// to a dead-letter address, and returns how many there were. Messages that
+// asked for NotifyExpiry still have a notice sent.
+func (exchange *Exchange) Purge(address string) int {
+	replyChan := make(chan int)
+	exchange.shardFor(address).purgeChan <- &purgeRequest{address, replyChan}
+	return <-replyChan
+}
+
+func (shard *exchangeShard) handlePeek(req *peekRequest) {
+	messageQueue, exists := shard.messageQueues[req.address]
+	if !exists {
+		req.replyChan <- nil
+		return
+	}
+
+	count := req.count
+	if count > messageQueue.Len() {
+		count = messageQueue.Len()
+	}
+
+	messages := make([]*Message, count)
+	for i := 0; i < count; i++ {
+		m := messageQueue.At(i).(Message)
+		messages[i] = &m
+	}
+	req.replyChan <- messages
+}
+
+func (shard *exchangeShard) handlePurge(req *purgeRequest) {
+	purged := 0
+	for shard.messageQueues[req.address] != nil {
+		m := shard.removeQueued(req.address, 0)
+		if shard.journal != nil {
+			shard.journalError(shard.journal.expired(m.id))
+		}
+		shard.notifyExpiry(m, ReasonPurged)
+		purged++
+	}
+
+	shard.logf(LogLevelInfo, "@ purge %v", req.address)
+	shard.logf(LogLevelInfo, "  %v purged", purged)
+	req.replyChan <- purged
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"os"
+)
+
+// SendBatch sends each of messages in turn, as SendMessage does, stopping
+// at the first that fails and returning its error. It returns how many of
+// messages were sent, which for a transactional batch is all or none.
+//
+// A transactional batch is all sent at once or not at all. Every message is
+// checked first, and if one has invalid headers, is mandatory, or doesn't
+// fit within its queue's limit (whatever the limit's policy), none are
+// sent. Otherwise every shard the batch touches handles its part without
+// anything else happening in between, and no shard carries on until every
+// part has been checked, so consumers see the whole batch or none of it.
+func (exchange *Exchange) SendBatch(messages []*Message, transactional bool) (int, os.Error) {
+	if !transactional {
+		for i, msg := range messages {
+			err := exchange.SendMessage(msg)
+			if err != nil {
+				return i, err
+			}
+		}
+		return len(messages), nil
+	}
+
+	parts := make(map[*exchangeShard]*batchPart)
+	for _, msg := range messages {
+		if msg.Mandatory || msg.MandatoryWaitMillis > 0 {
+			return 0, os.NewError("mandatory messages can't be sent in a transaction")
+		}
+
+		m, err := prepareMessage(msg)
+		if err != nil {
+			return 0, err
+		}
+		m.ToAddress = exchange.resolve(m.ToAddress)
+
+		shard := exchange.shardFor(m.ToAddress)
+		part, exists := parts[shard]
+		if !exists {
+			part = &batchPart{make([]Message, 0, len(messages)), nil, nil}
+			parts[shard] = part
+		}
+		part.messages = appendMessage(part.messages, m)
+	}
+
+	if len(parts) == 0 {
+		return 0, nil
+	}
+
+	var txn *transaction
+	if len(parts) > 1 {
+		// only one thing may hold several shards at once, or two of them
+		// could each be waiting on a shard the other holds
+		exchange.pauseLock.Lock()
+		defer exchange.pauseLock.Unlock()
+		txn = &transaction{decided: make(chan bool)}
+	}
+
+	replyChan := make(chan os.Error, len(parts))
+	for shard, part := range parts {
+		part.replyChan = replyChan
+		part.txn = txn
+		shard.batchChan <- part
+	}
+
+	var err os.Error
+	for i := 0; i < len(parts); i++ {
+		if partErr := <-replyChan; partErr != nil && err == nil {
+			err = partErr
+		}
+	}
+
+	if txn != nil {
+		txn.commit = err == nil
+		close(txn.decided)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	return len(messages), nil
+}
+
+// A batchPart is the part of a transactional batch owned by one shard.
+type batchPart struct {
+	messages  []Message
+	replyChan chan os.Error
+	// nil when the batch only touches one shard
+	txn *transaction
+}
+
+// A transaction decides whether the parts of a batch spread over several
+// shards are sent, once each shard has checked its part.
+type transaction struct {
+	decided chan bool
+	commit  bool
+}
+
+func (shard *exchangeShard) handleBatch(part *batchPart) {
+	err := shard.checkBatch(part.messages)
+	part.replyChan <- err
+
+	if part.txn != nil {
+		<-part.txn.decided
+		if !part.txn.commit {
+			return
+		}
+	}
+
+	if err == nil {
+		for _, m := range part.messages {
+			shard.handleMessage(m)
+		}
+	}
+}
+
+// checkBatch returns an error if any of messages wouldn't fit within its
+// queue's limit, counting the messages before it as already queued. Since
+// the clients waiting for them may be gone by the time the batch is sent,
+// messages are counted as queued even if somebody is waiting for them.
+func (shard *exchangeShard) checkBatch(messages []Message) os.Error {
+	pending := &pendingCounts{make(map[string]int), make(map[string]int)}
+	for i := range messages {
+		m := &messages[i]
+		if shard.overflowPolicyAfter(m, pending) != overflowNone {
+			return os.NewError("queue full: " + m.ToAddress)
+		}
+		
+		if shard.isImmediate(m) {
+			pending.add(m)
+		}
+	}
+	return nil
+}
+
+// pendingCounts counts messages that are about to be queued. A nil
+// *pendingCounts counts nothing.
+type pendingCounts struct {
+	depths map[string]int
+	bytes  map[string]int
+}
+
+func (pending *pendingCounts) add(m *Message) {
+	pending.depths[m.ToAddress]++
+	pending.bytes[m.ToAddress] += len(m.Body)
+}
+
+func (pending *pendingCounts) depth(address string) int {
+	if pending == nil {
+		return 0
+	}
+	return pending.depths[address]
+}
+
+func (pending *pendingCounts) addressBytes(address string) int {
+	if pending == nil {
+		return 0
+	}
+	return pending.bytes[address]
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"strconv"
+	"testing"
+)
+
+// newBatchExchange returns an exchange with several shards, not yet
+// started, and two addresses owned by different shards.
+func newBatchExchange() (*Exchange, string, string) {
+	exchange := newExchange(4)
+	exchange.SetLogLevel(LogLevelMinimal)
+
+	first, second := "batch.0", ""
+	for i := 1; second == ""; i++ {
+		address := "batch." + strconv.Itoa(i)
+		if exchange.shardFor(address) != exchange.shardFor(first) {
+			second = address
+		}
+	}
+	return exchange, first, second
+}
+
+func batchMessages(addresses []string) []*Message {
+	messages := make([]*Message, len(addresses))
+	for i, address := range addresses {
+		messages[i] = &Message{ToAddress: address, TimeoutMillis: 60000, Body: []byte("batch")}
+	}
+	return messages
+}
+
+// expectQueued checks that address has count messages queued.
+func expectQueued(t *testing.T, exchange *Exchange, address string, count int) {
+	for i := 0; i < count; i++ {
+		if exchange.Ready(0, []string{address}) == nil {
+			t.Errorf("%v had %v messages queued, expected %v", address, i, count)
+			return
+		}
+	}
+	if exchange.Ready(0, []string{address}) != nil {
+		t.Errorf("%v had more than %v messages queued", address, count)
+	}
+}
+
+func TestTransactionQueueLimits(t *testing.T) {
+	exchange, first, second := newBatchExchange()
+	exchange.SetQueueLimit(first, QueueLimit{MaxDepth: 2, Policy: OverflowReject})
+	exchange.SetQueueLimit(second, QueueLimit{MaxDepth: 1, Policy: OverflowReject})
+	exchange.Start()
+
+	// one too many for second, so none are sent
+	sent, err := exchange.SendBatch(batchMessages([]string{first, first, second, second}), true)
+	if err == nil || sent != 0 {
+		t.Errorf("transaction over the limit sent %v, with error %v", sent, err)
+	}
+	expectQueued(t, exchange, first, 0)
+	expectQueued(t, exchange, second, 0)
+
+	sent, err = exchange.SendBatch(batchMessages([]string{first, second, first}), true)
+	if err != nil || sent != 3 {
+		t.Errorf("transaction within the limit sent %v, with error %v", sent, err)
+	}
+	expectQueued(t, exchange, first, 2)
+	expectQueued(t, exchange, second, 1)
+
+	// without a transaction, the messages before the one that fails are sent
+	sent, err = exchange.SendBatch(batchMessages([]string{first, second, second, first}), false)
+	if err == nil || sent != 2 {
+		t.Errorf("batch over the limit sent %v, with error %v", sent, err)
+	}
+	expectQueued(t, exchange, first, 1)
+	expectQueued(t, exchange, second, 1)
+}
+
+func TestTransactionExchangeLimit(t *testing.T) {
+	exchange, first, second := newBatchExchange()
+	exchange.SetExchangeLimit(QueueLimit{MaxDepth: 2, Policy: OverflowReject})
+	exchange.Start()
+
+	sent, err := exchange.SendBatch(batchMessages([]string{first, second, first}), true)
+	if err == nil || sent != 0 {
+		t.Errorf("transaction over the limit sent %v, with error %v", sent, err)
+	}
+	expectQueued(t, exchange, first, 0)
+	expectQueued(t, exchange, second, 0)
+
+	sent, err = exchange.SendBatch(batchMessages([]string{first, second}), true)
+	if err != nil || sent != 2 {
+		t.Errorf("transaction within the limit sent %v, with error %v", sent, err)
+	}
+	expectQueued(t, exchange, first, 1)
+	expectQueued(t, exchange, second, 1)
+}
@@ -6,9 +6,10 @@ package msglite
 
 import (
 	"net"
-	"strconv"
 	"os"
 	"bufio"
+	"strconv"
+	"strings"
 )
 
 type Client struct {
@@ -30,28 +31,206 @@ func NewClient(network string, laddr string) (*Client, os.Error) {
 	return client, nil
 }
 
-func (client *Client) Send(body string, timeoutSeconds int64, toAddress string, replyAddress string) os.Error {
-	return client.stream.WriteMessage(&Message{toAddress, replyAddress, timeoutSeconds, body, 0})
+func (client *Client) Send(body []byte, timeoutMillis int64, toAddress string, replyAddress string) os.Error {
+	return client.SendMessage(&Message{ToAddress: toAddress, ReplyAddress: replyAddress, TimeoutMillis: timeoutMillis, Body: body})
+}
+
+// SendMessage sends msg, honoring any options set on it, such as Priority.
+// A mandatory message waits for the server to say whether it was sent, and
+// returns ErrNoListener if it wasn't.
+func (client *Client) SendMessage(msg *Message) os.Error {
+	err := client.stream.WriteMessage(msg)
+	if err != nil || !msg.Mandatory && msg.MandatoryWaitMillis <= 0 {
+		return err
+	}
+	
+	return client.readStatus()
+}
+
+// SendBatch sends messages in one go, as Exchange.SendBatch does, and
+// waits for the server to say how many were sent.
+func (client *Client) SendBatch(messages []*Message, transactional bool) (int, os.Error) {
+	outCommand := []string{batchCommandStr, strconv.Itoa(len(messages))}
+	if transactional {
+		outCommand = appendString(outCommand, transactionOptionStr + "=1")
+	}
+	
+	err := client.stream.WriteCommand(outCommand)
+	if err != nil {
+		return 0, err
+	}
+	
+	for _, msg := range messages {
+		err = client.stream.WriteMessage(msg)
+		if err != nil {
+			return 0, err
+		}
+	}
+	
+	inCommand, err := client.stream.ReadCommand()
+	if err != nil {
+		return 0, err
+	}
+	
+	switch {
+	case len(inCommand) == 2 && inCommand[0] == infoCommandStr && inCommand[1] == sentStatusStr:
+		return len(messages), nil
+	case len(inCommand) > 3 && inCommand[0] == infoCommandStr && inCommand[1] == sentStatusStr:
+		sent, err := strconv.Atoi(inCommand[2])
+		if err != nil {
+			break
+		}
+		return sent, os.NewError(strings.Join(inCommand[3:], " "))
+	case len(inCommand) > 1 && inCommand[0] == errorCommandStr:
+		return 0, os.NewError(strings.Join(inCommand[1:], " "))
+	}
+	return 0, os.NewError("invalid reply from server")
+}
+
+// readStatus reads the server's answer to a mandatory message.
+func (client *Client) readStatus() os.Error {
+	inCommand, err := client.stream.ReadCommand()
+	if err != nil {
+		return err
+	}
+	
+	switch {
+	case len(inCommand) == 2 && inCommand[0] == infoCommandStr && inCommand[1] == sentStatusStr:
+		return nil
+	case len(inCommand) == 2 && inCommand[0] == infoCommandStr && inCommand[1] == noListenerStatusStr:
+		return ErrNoListener
+	case len(inCommand) > 1 && inCommand[0] == errorCommandStr:
+		return os.NewError(strings.Join(inCommand[1:], " "))
+	}
+	return os.NewError("invalid reply from server")
+}
+
+// Broadcast sends a copy of body to every client waiting on toAddress and
+// to every subscriber of toAddress.
+func (client *Client) Broadcast(body []byte, timeoutMillis int64, toAddress string, replyAddress string) os.Error {
+	return client.SendMessage(&Message{ToAddress: toAddress, ReplyAddress: replyAddress, TimeoutMillis: timeoutMillis, Body: body, Fanout: true})
+}
+
+// Subscribe registers queueAddress as a durable subscriber of toAddress, so
+// broadcasts to toAddress are queued on queueAddress.
+func (client *Client) Subscribe(toAddress string, queueAddress string) os.Error {
+	return client.stream.WriteCommand([]string{subscribeCommandStr, toAddress, queueAddress})
+}
+
+func (client *Client) Unsubscribe(toAddress string, queueAddress string) os.Error {
+	return client.stream.WriteCommand([]string{unsubscribeCommandStr, toAddress, queueAddress})
+}
+
+func (client *Client) Ready(timeoutMillis int64, onAddresses []string) (*Message, os.Error) {
+	return client.ReadyAck(timeoutMillis, onAddresses, 0)
+}
+
+// ReadyAck is like Ready, but unless ackTimeoutMillis is zero, the message
+// it returns carries a DeliveryId and must be passed to Ack within
+// ackTimeoutMillis, or it will be delivered again. Unacked messages are
+// also delivered again if the connection closes.
+func (client *Client) ReadyAck(timeoutMillis int64, onAddresses []string, ackTimeoutMillis int64) (*Message, os.Error) {
+	return client.ReadyWith(timeoutMillis, onAddresses, &ReadyOptions{AckTimeoutMillis: ackTimeoutMillis})
+}
+
+// ReadyWith is like Ready, with options, which work as they do for
+// Exchange.ReadyWith.
+func (client *Client) ReadyWith(timeoutMillis int64, onAddresses []string, options *ReadyOptions) (*Message, os.Error) {
+	err := client.writeReady(timeoutMillis, onAddresses, options, nil)
+	if err != nil {
+		return nil, err
+	}
+	
+	return client.stream.ReadMessage()
 }
 
-func (client *Client) Ready(timeoutSeconds int64, onAddresses []string) (*Message, os.Error) {
-	outCommand := make([]string, len(onAddresses) + 2)
+// writeReady writes a ready command with options, followed by any extra
+// options.
+func (client *Client) writeReady(timeoutMillis int64, onAddresses []string, options *ReadyOptions, extra []string) os.Error {
+	if options.Weights != nil && len(options.Weights) != len(onAddresses) {
+		return os.NewError("a weight is needed for each address")
+	}
+	
+	outCommand := make([]string, len(onAddresses) + 2, len(onAddresses) + 3)
 	outCommand[0] = readyCommandStr
-	outCommand[1] = strconv.Itoa64(timeoutSeconds)
+	outCommand[1] = FormatMillis(timeoutMillis)
 	for i := 0; i < len(onAddresses); i++ {
 		outCommand[i+2] = onAddresses[i]
 	}
 	
-	err := client.stream.WriteCommand(outCommand)
+	if options.AckTimeoutMillis != 0 {
+		outCommand = appendString(outCommand, ackOptionStr + "=" + FormatMillis(options.AckTimeoutMillis))
+	}
+	
+	if options.Weights != nil {
+		outCommand = appendString(outCommand, weightsOptionStr + "=" + formatWeights(options.Weights))
+	} else if options.Fair {
+		outCommand = appendString(outCommand, fairOptionStr + "=1")
+	}
+	
+	for _, option := range extra {
+		outCommand = appendString(outCommand, option)
+	}
+	
+	return client.stream.WriteCommand(outCommand)
+}
+
+// ReadyBatch is like Ready, but returns up to count messages at once, as
+// Exchange.ReadyBatch does. It returns an empty slice if the Ready times
+// out.
+func (client *Client) ReadyBatch(timeoutMillis int64, onAddresses []string, count int) ([]*Message, os.Error) {
+	return client.ReadyBatchWith(timeoutMillis, onAddresses, count, new(ReadyOptions))
+}
+
+// ReadyBatchWith is like ReadyBatch, with options.
+func (client *Client) ReadyBatchWith(timeoutMillis int64, onAddresses []string, count int, options *ReadyOptions) ([]*Message, os.Error) {
+	if count < 1 {
+		return nil, os.NewError("batch size must be at least 1")
+	}
+	
+	err := client.writeReady(timeoutMillis, onAddresses, options, []string{batchOptionStr + "=" + strconv.Itoa(count)})
 	if err != nil {
 		return nil, err
 	}
 	
-	return client.stream.ReadMessage()
+	return client.readMessages(count)
+}
+
+// readMessages reads messages up to the "*" that ends them, which reads as
+// a nil message. If max isn't negative, more than max is an error.
+func (client *Client) readMessages(max int) ([]*Message, os.Error) {
+	messages := make([]*Message, 0, 16)
+	for {
+		msg, err := client.stream.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			return messages, nil
+		}
+		
+		if max >= 0 && len(messages) == max {
+			return nil, os.NewError("invalid batch from server")
+		}
+		if len(messages) == cap(messages) {
+			newMessages := make([]*Message, len(messages), 2 * len(messages))
+			copy(newMessages, messages)
+			messages = newMessages
+		}
+		messages = messages[0:len(messages)+1]
+		messages[len(messages)-1] = msg
+	}
+	panic("unreachable")
+}
+
+func (client *Client) Query(body []byte, timeoutMillis int64, toAddress string) (*Message, os.Error) {
+	return client.QueryMessage(&Message{ToAddress: toAddress, TimeoutMillis: timeoutMillis, Body: body})
 }
 
-func (client *Client) Query(body string, timeoutSeconds int64, toAddress string) (*Message, os.Error) {
-	err := client.stream.WriteQuery(body, timeoutSeconds, toAddress)
+// QueryMessage sends msg as a query and waits for the reply, honoring any
+// options set on msg, such as Priority.
+func (client *Client) QueryMessage(msg *Message) (*Message, os.Error) {
+	err := client.stream.WriteQuery(msg)
 	if err != nil {
 		return nil, err
 	}
@@ -59,6 +238,50 @@ func (client *Client) Query(body string, timeoutSeconds int64, toAddress string)
 	return client.stream.ReadMessage()
 }
 
+// QueryAll sends msg as a query to each of toAddresses and gathers the
+// replies, as Exchange.QueryAll does.
+func (client *Client) QueryAll(msg *Message, toAddresses []string, quorum int) ([]*Message, os.Error) {
+	if quorum < 0 {
+		return nil, os.NewError("quorum can't be negative")
+	}
+	
+	err := client.stream.WriteGatherQuery(msg, toAddresses, quorum)
+	if err != nil {
+		return nil, err
+	}
+	
+	return client.readMessages(-1)
+}
+
+// QueryStream sends msg as a query and returns the stream of replies to
+// it. The stream must be read to its end before anything else is done with
+// the client.
+func (client *Client) QueryStream(msg *Message) (*ReplyStream, os.Error) {
+	err := client.stream.WriteStreamQuery(msg)
+	if err != nil {
+		return nil, err
+	}
+	
+	return &ReplyStream{receive: client.stream.ReadMessage}, nil
+}
+
+// Ack acknowledges a message received through ReadyAck.
+func (client *Client) Ack(deliveryId string) os.Error {
+	return client.stream.WriteCommand([]string{ackCommandStr, deliveryId})
+}
+
+// Requeue gives up on a message received through ReadyAck so it can be
+// delivered again right away.
+func (client *Client) Requeue(deliveryId string) os.Error {
+	return client.stream.WriteCommand([]string{ackCommandStr, deliveryId, requeueParamStr})
+}
+
+// Reject gives up on a message received through ReadyAck for good, so it
+// is moved to its dead-letter address instead of being delivered again.
+func (client *Client) Reject(deliveryId string) os.Error {
+	return client.stream.WriteCommand([]string{ackCommandStr, deliveryId, rejectParamStr})
+}
+
 func (client *Client) Quit() os.Error {
 	err := client.stream.WriteQuit()
 	client.conn.Close()
@@ -9,15 +9,26 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"strconv"
 )
 
 var client *msglite.Client
+var priority int
+var notBefore int64
+var delay string
+var batch int
+var quorum int
+var notify bool
 
 func main() {
 	var network, laddr string
 	flag.StringVar(&network, "network", "unix", "unix or tcp")
 	flag.StringVar(&laddr, "address", "", "listen address (either socket path, or ip:port)")
+	flag.IntVar(&priority, "priority", 0, "priority of sent messages and queries (higher is delivered first)")
+	flag.StringVar(&delay, "delay", "0", "time to hold sent messages before they can be delivered, in seconds or milliseconds if followed by ms")
+	flag.IntVar(&batch, "batch", 1, "most messages to receive at once with ready")
+	flag.BoolVar(&notify, "notify", false, "ask for a notice on the reply address if sent messages or queries expire undelivered")
+	flag.IntVar(&quorum, "quorum", 0, "replies to wait for when querying several addresses (0 waits for all of them)")
+	flag.Int64Var(&notBefore, "not-before", 0, "time (in seconds since the epoch) before which sent messages can't be delivered")
 	flag.Parse()
 	
 	if laddr == "" {
@@ -37,18 +48,24 @@ func main() {
 	
 	switch flag.Arg(0) {
 	case "send":
-		doSend()
+		doSend(false)
+	case "broadcast":
+		doSend(true)
+	case "subscribe":
+		doSubscribe(true)
+	case "unsubscribe":
+		doSubscribe(false)
 	case "ready":
 		doReady()
 	case "query":
 		doQuery()
 	default:
-		fmt.Println("command must be one of send, ready, or query")
+		fmt.Println("command must be one of send, broadcast, subscribe, unsubscribe, ready, or query")
 		os.Exit(1)
 	}
 }
 
-func doSend() {
+func doSend(broadcast bool) {
 	body := flag.Arg(1)
 	timeoutStr := flag.Arg(2)
 	toAddr := flag.Arg(3)
@@ -57,12 +74,32 @@ func doSend() {
 		replyAddr = flag.Arg(4)
 	}
 	
-	timeout, err := strconv.Atoi64(timeoutStr)
+	timeout, err := msglite.ParseMillis(timeoutStr)
 	if err != nil {
 		panic(err)
 	}
 	
-	err = client.Send(body, timeout, toAddr, replyAddr)
+	delayMillis, err := msglite.ParseMillis(delay)
+	if err != nil {
+		panic(err)
+	}
+	
+	err = client.SendMessage(&msglite.Message{ToAddress: toAddr, ReplyAddress: replyAddr, TimeoutMillis: timeout, Body: []byte(body), Fanout: broadcast, Priority: priority, DelayMillis: delayMillis, NotBefore: notBefore, NotifyExpiry: notify})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func doSubscribe(subscribe bool) {
+	toAddr := flag.Arg(1)
+	queueAddr := flag.Arg(2)
+	
+	var err os.Error
+	if subscribe {
+		err = client.Subscribe(toAddr, queueAddr)
+	} else {
+		err = client.Unsubscribe(toAddr, queueAddr)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -70,19 +107,30 @@ func doSend() {
 
 func doReady() {
 	timeoutStr := flag.Arg(1)
-	timeout, err := strconv.Atoi64(timeoutStr)
+	timeout, err := msglite.ParseMillis(timeoutStr)
 	if err != nil {
 		panic(err)
 	}
 	
-	var addrs [8]string
-	addrCount := 0
-	for i := 2; i <= flag.NArg(); i++ {
-		addrs[i-2] = flag.Arg(i)
-		addrCount++
+	addrs := make([]string, flag.NArg() - 2)
+	for i := 0; i < len(addrs); i++ {
+		addrs[i] = flag.Arg(i + 2)
 	}
 	
-	msg, err := client.Ready(timeout, addrs[0:addrCount])
+	if batch > 1 {
+		messages, err := client.ReadyBatch(timeout, addrs, batch)
+		if err != nil {
+			panic(err)
+		}
+		
+		for _, msg := range messages {
+			printMsg(msg)
+		}
+		fmt.Println("*")
+		return
+	}
+	
+	msg, err := client.Ready(timeout, addrs)
 	if err != nil {
 		panic(err)
 	}
@@ -95,12 +143,30 @@ func doQuery() {
 	timeoutStr := flag.Arg(2)
 	toAddr := flag.Arg(3)
 	
-	timeout, err := strconv.Atoi64(timeoutStr)
+	timeout, err := msglite.ParseMillis(timeoutStr)
 	if err != nil {
 		panic(err)
 	}
 	
-	msg, err := client.Query(body, timeout, toAddr)
+	if flag.NArg() > 4 || quorum > 0 {
+		addrs := make([]string, flag.NArg() - 3)
+		for i := 0; i < len(addrs); i++ {
+			addrs[i] = flag.Arg(i + 3)
+		}
+		
+		replies, err := client.QueryAll(&msglite.Message{TimeoutMillis: timeout, Body: []byte(body), Priority: priority, NotifyExpiry: notify}, addrs, quorum)
+		if err != nil {
+			panic(err)
+		}
+		
+		for _, msg := range replies {
+			printMsg(msg)
+		}
+		fmt.Println("*")
+		return
+	}
+	
+	msg, err := client.QueryMessage(&msglite.Message{ToAddress: toAddr, TimeoutMillis: timeout, Body: []byte(body), Priority: priority, NotifyExpiry: notify})
 	if err != nil {
 		panic(err)
 	}
@@ -114,8 +180,17 @@ func printMsg(msg *msglite.Message) {
 		return
 	}
 	
-	fmt.Printf("> %v %v %v %v\n", len(msg.Body), msg.TimeoutSeconds, msg.ToAddress, msg.ReplyAddress)
-	if msg.Body != "" {
-		fmt.Println(msg.Body)
+	fmt.Printf("> %v %v %v %v", len(msg.Body), msglite.FormatMillis(msg.TimeoutMillis), msg.ToAddress, msg.ReplyAddress)
+	if msg.Reason != "" {
+		// a dead letter or an expiry notice
+		fmt.Printf(" reason=%v origto=%v", msg.Reason, msg.OriginalAddress)
+	}
+	fmt.Println()
+	for key, value := range msg.Headers {
+		fmt.Printf("%v: %v\n", key, value)
+	}
+	if len(msg.Body) > 0 {
+		os.Stdout.Write(msg.Body)
+		fmt.Println()
 	}
 }
@@ -5,8 +5,14 @@
 package msglite
 
 import (
+	"crypto/rand"
 	"fmt"
+	"io"
+	"container/list"
 	"container/vector"
+	"os"
+	"runtime"
+	"sync"
 	"time"
 	"strings"
 )
@@ -18,226 +24,1340 @@ const (
 	LogLevelDebug
 )
 
+// reasons given on messages moved to a dead-letter address
+const (
+	ReasonExpired  = "expired"
+	ReasonRejected = "rejected"
+	ReasonOverflow = "overflow"
+	ReasonPurged   = "purged"
+)
+
+const defaultDeadLetterTimeout = 86400 * 1000
+
+// how long an expiry notice waits on its reply address, in milliseconds
+const expiryNoticeTimeout = 60 * 1000
+
+// how much longer than its message's timeout a query that asked for expiry
+// notices waits, in milliseconds, so the notice sent when the message
+// expires arrives before the query gives up
+const expiryNoticeGrace = 1000
+
+// the most replies QueryAll takes at once while it doesn't know how many
+// to expect
+const defaultGatherBatch = 64
+
+// The exchange doesn't copy message bodies, so a body must not be modified
+// once its message has been sent, and the body of a received message may
+// be shared with copies delivered elsewhere.
+//
+// TimeoutMillis and DelayMillis are in milliseconds, while NotBefore is in
+// seconds since the epoch.
+//
+// A message with NotifyExpiry set that expires, overflows its queue, is
+// rejected or is purged has a notice sent to its reply address. The notice
+// has no body, and its Reason and OriginalAddress say what happened to the
+// message and where it was sent, so a query can tell a message nobody
+// picked up from a reply that was too slow.
 type Message struct {
 	ToAddress string
 	ReplyAddress string
-	TimeoutSeconds int64
-	Body string
+	TimeoutMillis int64
+	Body []byte
+	Fanout bool
+	Priority int
+	DelayMillis int64
+	NotBefore int64
+	DeliveryId string
+	OriginalAddress string
+	Reason string
+	Headers map[string]string
+	Mandatory bool
+	MandatoryWaitMillis int64
+	EndOfStream bool
+	NotifyExpiry bool
 	timeout int64
+	notBefore int64
+	id uint64
+	deadline *deadline
+	// set on the copy of a broadcast handed to each waiting client
+	broadcastCopy bool
 }
 
-const maxOnAddresses = 8
-
 type readyState struct {
-	onAddresses [maxOnAddresses]string
-	onAddressCount int
+	onAddresses []string
+	// weights is nil unless the Ready is fair
+	weights []int
+	// indexes holds the position of each of onAddresses among the
+	// addresses of the whole Ready
+	indexes []int
+	// a probe only reports which of onAddresses have messages queued, in
+	// eligible, and is never queued or answered
+	probe bool
+	eligible []bool
+	queueElements []*list.Element
+	// count is the most messages a batch Ready takes at once
+	count int
 	timeout int64
-	messageChan chan <- Message
-	timeoutReceived bool
+	ackTimeout int64
+	seq uint64
+	deadline *deadline
+	waiter *waiter
+	shard *exchangeShard
 }
 
+// An Exchange is split into shards, each of which owns the addresses that
+// hash to it and runs in its own goroutine, so the exchange can use as
+// many cores as there are shards.
 type Exchange struct {
+	shards               []*exchangeShard
+	totals               *queueTotals
+	
+	// held by anything that holds more than one shard at once
+	pauseLock            sync.Mutex
+	
+	routeLock            sync.Mutex
+	routes               map [string] *routeState
+	
+	// scheduleLock guards schedules, which fair Readys on any shard share
+	scheduleLock         sync.Mutex
+	schedules            map [string] *schedule
+	schedulesPruned      int64
+	
+	// addressLock guards owners
+	addressLock          sync.Mutex
+	owners               map [string] *AddressOwner
+	
+	journal              *journal
+}
+
+type exchangeShard struct {
+	exchange             *Exchange
+	
 	readyStateChan       chan *readyState
-	messageChan          chan Message
-	unusedAddressReqChan chan (chan string)
+	messageChan          chan *sendRequest
+	forwardChan          chan Message
+	forwarders           map [*exchangeShard] *forwarder
+	returnChan           chan Message
+	subscriptionChan     chan subscription
+	ackChan              chan ackRequest
+	cancelChan           chan *readyState
+	pauseChan            chan *compaction
+	batchChan            chan *batchPart
+	wakeChan             chan bool
+	statsChan            chan chan *Stats
+	peekChan             chan *peekRequest
+	purgeChan            chan *purgeRequest
 	
-	readyStateQueues     map [string] *vector.Vector
+	readyStateQueues     map [string] *list.List
+	readyPatterns        map [string] bool
 	messageQueues        map [string] *vector.Vector
+	delayedMessages      *vector.Vector
+	fanoutAddresses      map [string] bool
+	subscribers          map [string] *vector.StringVector
+	inFlight             map [string] *inFlightMessage
+	deadLetterAddress    string
+	deadLetterAddresses  map [string] string
+	deadLetterTimeout    int64
+	
+	queueLimits          map [string] *QueueLimit
+	defaultQueueLimit    *QueueLimit
+	exchangeLimit        *QueueLimit
+	queueBytes           map [string] int
+	totals               *queueTotals
+	// room in totals taken for messages this shard is about to queue
+	reservedCount        int
+	reservedBytes        int
+	blockedSenders       map [string] *vector.Vector
+	blockedCount         int
+	awaitingSenders      map [string] *vector.Vector
+	awaitingCount        int
 	
 	logLevel             int
-	unusedAddressCounter uint32
-}
-
-func NewExchange() (exchange *Exchange) {
-	exchange = &Exchange{
-		make(chan *readyState),
-		make(chan Message),
-		make(chan (chan string)),
-		make(map [string] *vector.Vector),
-		make(map [string] *vector.Vector),
-		LogLevelInfo,
-		0,
-	}
-	
-	ticker := time.NewTicker(1e9)
-	
-	go func() {
-		for {
-			select {
-			case rs := <-exchange.readyStateChan:
-				exchange.handleReadyState(rs)
-			case m := <-exchange.messageChan:
-				exchange.handleMessage(m)
-			case replyChan := <-exchange.unusedAddressReqChan:
-				exchange.handleUnusedAddressReq(replyChan)
-			case t := <-ticker.C:
-				exchange.handleTick(t)
-			}
+	// ids and delivery ids are unique across shards because each shard
+	// counts up from its own index in steps of the number of shards
+	stride               uint64
+	messageCounter       uint64
+	readyStateCounter    uint64
+	deliveryCounter      uint64
+	
+	sentCount            uint64
+	deliveredCount       uint64
+	expiredCount         uint64
+	timeoutCount         uint64
+	
+	deadlines            *deadlineHeap
+	timer                *time.Timer
+	timerAt              int64
+	
+	journal              *journal
+}
+
+func newExchange(shardCount int) *Exchange {
+	exchange := &Exchange{
+		shards: make([]*exchangeShard, shardCount),
+		totals: new(queueTotals),
+		owners: make(map [string] *AddressOwner),
+		routes: make(map [string] *routeState),
+		schedules: make(map [string] *schedule),
+	}
+	
+	for i := 0; i < shardCount; i++ {
+		exchange.shards[i] = &exchangeShard{
+			exchange:             exchange,
+			readyStateChan:       make(chan *readyState),
+			messageChan:          make(chan *sendRequest),
+			forwardChan:          make(chan Message),
+			forwarders:           make(map [*exchangeShard] *forwarder),
+			returnChan:           make(chan Message),
+			subscriptionChan:     make(chan subscription),
+			ackChan:              make(chan ackRequest),
+			cancelChan:           make(chan *readyState),
+			pauseChan:            make(chan *compaction),
+			batchChan:            make(chan *batchPart),
+			wakeChan:             make(chan bool, 1),
+			statsChan:            make(chan chan *Stats),
+			peekChan:             make(chan *peekRequest),
+			purgeChan:            make(chan *purgeRequest),
+			readyStateQueues:     make(map [string] *list.List),
+			readyPatterns:        make(map [string] bool),
+			messageQueues:        make(map [string] *vector.Vector),
+			delayedMessages:      new(vector.Vector),
+			fanoutAddresses:      make(map [string] bool),
+			subscribers:          make(map [string] *vector.StringVector),
+			inFlight:             make(map [string] *inFlightMessage),
+			deadLetterAddresses:  make(map [string] string),
+			deadLetterTimeout:    defaultDeadLetterTimeout,
+			queueLimits:          make(map [string] *QueueLimit),
+			queueBytes:           make(map [string] int),
+			totals:               exchange.totals,
+			blockedSenders:       make(map [string] *vector.Vector),
+			awaitingSenders:      make(map [string] *vector.Vector),
+			logLevel:             LogLevelInfo,
+			stride:               uint64(shardCount),
+			messageCounter:       uint64(i),
+			deliveryCounter:      uint64(i),
+			deadlines:            new(deadlineHeap),
+		}
+	}
+	
+	return exchange
+}
+
+// NewExchange creates an exchange with one shard for each of the
+// GOMAXPROCS threads that may run at once. It can be configured, and is
+// put to use once Start is called.
+func NewExchange() *Exchange {
+	return newExchange(runtime.GOMAXPROCS(0))
+}
+
+// NewJournaledExchange creates an exchange that records its message queues
+// in the journal at journalPath. Messages that were still queued and had
+// not yet expired when the journal was last written are queued again with
+// their original deadlines. Like NewExchange, it returns an exchange that
+// doesn't run until Start is called, so none of them expire before it is
+// configured.
+func NewJournaledExchange(journalPath string) (*Exchange, os.Error) {
+	exchange := newExchange(runtime.GOMAXPROCS(0))
+	
+	j, state, err := openJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	
+	for toAddress, queueAddresses := range state.subscribers {
+		exchange.shardFor(toAddress).subscribers[toAddress] = queueAddresses
+	}
+	
+	var maxId uint64
+	now := time.Nanoseconds()
+	for i := 0; i < len(state.messages); i++ {
+		m := state.messages[i]
+		if m.id > maxId {
+			maxId = m.id
+		}
+		
+		shard := exchange.shardFor(m.ToAddress)
+		if m.notBefore > now {
+			shard.delayMessage(m)
+		} else {
+			shard.queueMessage(m)
 		}
-	}()
+	}
+	
+	// new ids have to be greater than any in the journal
+	for _, shard := range exchange.shards {
+		shard.messageCounter += maxId - maxId % shard.stride
+		shard.journal = j
+	}
 	
-	return
+	exchange.journal = j
+	return exchange, nil
 }
 
+// Start sets the exchange running. The shards read their settings without
+// locking, so SetLogLevel, SetFanout, the dead-letter addresses and the
+// queue limits must all be set before it is called. Routes can be changed
+// at any time.
+func (exchange *Exchange) Start() {
+	for _, shard := range exchange.shards {
+		go shard.run()
+	}
+}
+
+func (shard *exchangeShard) run() {
+	for {
+		select {
+		case rs := <-shard.readyStateChan:
+			if rs.probe {
+				shard.probeReadyState(rs)
+			} else {
+				shard.handleReadyState(rs)
+			}
+			rs.waiter.placedChan <- true
+		case req := <-shard.messageChan:
+			shard.handleSendRequest(req)
+		case m := <-shard.forwardChan:
+			shard.handleMessage(m)
+		case m := <-shard.returnChan:
+			shard.handleReturn(m)
+		case s := <-shard.subscriptionChan:
+			shard.handleSubscription(s)
+		case a := <-shard.ackChan:
+			shard.handleAck(a)
+		case rs := <-shard.cancelChan:
+			shard.handleCancel(rs)
+		case c := <-shard.pauseChan:
+			shard.handlePause(c)
+		case part := <-shard.batchChan:
+			shard.handleBatch(part)
+		case <-shard.wakeChan:
+			// room has been made on another shard
+		case replyChan := <-shard.statsChan:
+			replyChan <- shard.stats()
+		case req := <-shard.peekChan:
+			shard.handlePeek(req)
+		case req := <-shard.purgeChan:
+			shard.handlePurge(req)
+		case <-shard.deadlineTimer():
+			shard.handleDeadlines()
+		}
+		
+		if shard.blockedCount > 0 {
+			shard.admitBlockedSenders()
+		}
+		
+		if shard.awaitingCount > 0 {
+			shard.admitAwaitingSenders()
+		}
+		
+		if shard.reservedCount > 0 {
+			shard.releaseReserved()
+		}
+		
+		if shard.journal != nil && shard.journal.startCompaction() {
+			go shard.exchange.compactJournal()
+		}
+	}
+}
+
+// SetLogLevel sets how much the exchange logs, to one of the LogLevel
+// constants.
 func (exchange *Exchange) SetLogLevel(l int) {
-	exchange.logLevel = l
+	for _, shard := range exchange.shards {
+		shard.logLevel = l
+	}
+}
+
+// SetFanout marks an address as fan-out, so every message sent to it is
+// broadcast as if it had been sent with Broadcast.
+func (exchange *Exchange) SetFanout(address string, fanout bool) {
+	shard := exchange.shardFor(address)
+	if fanout {
+		shard.fanoutAddresses[address] = true
+	} else {
+		shard.fanoutAddresses[address] = false, false
+	}
+}
+
+// SetDeadLetterAddress sets the address to which messages that expire or
+// are rejected are moved, unless their address has its own dead-letter
+// address. Dead letters carry their original address and the reason they
+// were moved, and expire after timeoutMillis.
+func (exchange *Exchange) SetDeadLetterAddress(deadLetterAddress string, timeoutMillis int64) {
+	for _, shard := range exchange.shards {
+		shard.deadLetterAddress = deadLetterAddress
+		shard.deadLetterTimeout = timeoutMillis
+	}
 }
 
-func (exchange *Exchange) log(level int, s string) {
-	if level <= exchange.logLevel {
+// SetAddressDeadLetterAddress sets the dead-letter address for messages
+// sent to address, overriding the exchange-wide one.
+func (exchange *Exchange) SetAddressDeadLetterAddress(address string, deadLetterAddress string) {
+	exchange.shardFor(address).deadLetterAddresses[address] = deadLetterAddress
+}
+
+func (shard *exchangeShard) log(level int, s string) {
+	if level <= shard.logLevel {
 		fmt.Println(s)
 	}
 }
 
-func (exchange *Exchange) logf(level int, format string, v ...interface{}) {
-	exchange.log(level, fmt.Sprintf(format, v))
+func (shard *exchangeShard) logf(level int, format string, v ...interface{}) {
+	shard.log(level, fmt.Sprintf(format, v))
 }
 
-func (exchange *Exchange) handleReadyState(rs *readyState) {
-	if exchange.logLevel == LogLevelDebug {
-		exchange.logf(LogLevelDebug, "< _ %v", strings.Join(rs.onAddresses[0:rs.onAddressCount], " "))
+func (shard *exchangeShard) handleReadyState(rs *readyState) {
+	if shard.logLevel == LogLevelDebug {
+		shard.logf(LogLevelDebug, "< _ %v", strings.Join(rs.onAddresses, " "))
 	}
 	
-	for i := 0; i < rs.onAddressCount; i++ {
-		if messageQueue, exists := exchange.messageQueues[rs.onAddresses[i]]; exists {
-			m := messageQueue.At(0).(Message)
-			
-			exchange.logf(LogLevelInfo, "> %v %v %v %v", len(m.Body), m.TimeoutSeconds, m.ToAddress, m.ReplyAddress)
-			exchange.logf(LogLevelInfo, "  received, %v left in queue", messageQueue.Len() - 1)
+	if rs.waiter.isClaimed() {
+		// already answered by another shard
+		return
+	}
+	
+	now := time.Nanoseconds()
+	
+	if address, exists := shard.pickQueuedAddress(rs, now); exists {
+		if !shard.claim(rs) {
+			return
+		}
+		
+		// a batch takes whatever else is already queued here, up to its
+		// size, which the client chose and so is no guide to allocation
+		size := shard.messageQueues[address].Len()
+		if size > rs.count {
+			size = rs.count
+		}
+		messages := make([]Message, 0, size)
+		for exists && len(messages) < rs.count {
+			left := shard.messageQueues[address].Len() - 1
+			m := shard.removeQueued(address, 0)
 			
-			rs.messageChan <- m
-			messageQueue.Delete(0)
-			if messageQueue.Len() == 0 {
-				exchange.messageQueues[rs.onAddresses[i]] = nil, false
-			}
+			shard.logf(LogLevelInfo, "> %v %v %v %v", len(m.Body), FormatMillis(m.TimeoutMillis), m.ToAddress, m.ReplyAddress)
+			shard.logf(LogLevelInfo, "  received, %v left in queue", left)
 			
-			return
+			messages = appendMessage(messages, shard.handOver(rs, m, true))
+			address, exists = shard.pickQueuedAddress(rs, now)
 		}
+		
+		rs.waiter.messageChan <- messages
+		return
 	}
 	
 	// no queued messages
-	exchange.logf(LogLevelDebug, "  waiting")
+	shard.logf(LogLevelDebug, "  waiting")
+	
+	shard.readyStateCounter++
+	rs.seq = shard.readyStateCounter
 	
-	for i := 0; i < rs.onAddressCount; i++ {
-		if exchange.readyStateQueues[rs.onAddresses[i]] == nil {
-			exchange.readyStateQueues[rs.onAddresses[i]] = new(vector.Vector)
+	// remembering where rs sits in each queue lets unqueueReadyState
+	// remove it without searching
+	rs.queueElements = make([]*list.Element, len(rs.onAddresses))
+	for i, onAddress := range(rs.onAddresses) {
+		if shard.readyStateQueues[onAddress] == nil {
+			shard.readyStateQueues[onAddress] = list.New()
+			if isPattern(onAddress) {
+				shard.readyPatterns[onAddress] = true
+			}
 		}
-		exchange.readyStateQueues[rs.onAddresses[i]].Push(rs)
+		rs.queueElements[i] = shard.readyStateQueues[onAddress].PushBack(rs)
 	}
+	
+	rs.deadline = shard.addDeadline(rs.timeout, func() {
+		shard.timeoutReadyState(rs)
+	})
 }
 
-func (exchange *Exchange) unqueueReadyState(rs *readyState) {
-	for i := 0; i < rs.onAddressCount; i++ {
-		readyStateQueue := exchange.readyStateQueues[rs.onAddresses[i]]
-		for j := 0; j < readyStateQueue.Len(); j++ {
-			if readyStateQueue.At(j).(*readyState) == rs {
-				readyStateQueue.Delete(j)
-				if readyStateQueue.Len() == 0 {
-					exchange.readyStateQueues[rs.onAddresses[i]] = nil, false
-				}
-				break
-			}
+// findQueuedAddress returns the address of the queue a ready state waiting
+// on onAddress should take its next message from. When onAddress is a
+// pattern, that is the matching queue whose head would be queued first.
+func (shard *exchangeShard) findQueuedAddress(onAddress string, now int64) (string, bool) {
+	if !isPattern(onAddress) {
+		return onAddress, shard.hasUnexpired(onAddress, now)
+	}
+	
+	found := false
+	var foundAddress string
+	var foundHead Message
+	
+	for address, messageQueue := range(shard.messageQueues) {
+		if !matchAddress(onAddress, address) || !shard.hasUnexpired(address, now) {
+			continue
+		}
+		
+		head := messageQueue.At(0).(Message)
+		if !found || queuedBefore(head, foundHead) {
+			found = true
+			foundAddress = address
+			foundHead = head
+		}
+	}
+	
+	return foundAddress, found
+}
+
+// hasUnexpired expires any messages at the head of the queue on address
+// whose deadline has passed but hasn't fired yet, and reports whether
+// there are messages left.
+func (shard *exchangeShard) hasUnexpired(address string, now int64) bool {
+	messageQueue, exists := shard.messageQueues[address]
+	if !exists {
+		return false
+	}
+	
+	for messageQueue.Len() > 0 && messageQueue.At(0).(Message).timeout < now {
+		shard.expireMessage(shard.removeQueued(address, 0))
+	}
+	
+	return messageQueue.Len() > 0
+}
+
+// oldestReadyState returns the ready state that has been waiting longest
+// on address, either directly or through a pattern, or nil if there is
+// none.
+func (shard *exchangeShard) oldestReadyState(address string) *readyState {
+	var oldest *readyState
+	
+	if readyStateQueue, exists := shard.readyStateQueues[address]; exists {
+		oldest = readyStateQueue.Front().Value.(*readyState)
+	}
+	
+	for pattern := range(shard.readyPatterns) {
+		if !matchAddress(pattern, address) {
+			continue
+		}
+		
+		rs := shard.readyStateQueues[pattern].Front().Value.(*readyState)
+		if oldest == nil || rs.seq < oldest.seq {
+			oldest = rs
+		}
+	}
+	
+	return oldest
+}
+
+func (shard *exchangeShard) removeReadyStateQueue(onAddress string) {
+	shard.readyStateQueues[onAddress] = nil, false
+	shard.readyPatterns[onAddress] = false, false
+}
+
+func (shard *exchangeShard) unqueueReadyState(rs *readyState) {
+	for i, onAddress := range(rs.onAddresses) {
+		readyStateQueue := shard.readyStateQueues[onAddress]
+		readyStateQueue.Remove(rs.queueElements[i])
+		if readyStateQueue.Len() == 0 {
+			shard.removeReadyStateQueue(onAddress)
 		}
 	}
+	rs.queueElements = nil
+	
+	shard.removeDeadline(rs.deadline)
 }
 
-func (exchange *Exchange) handleMessage(m Message) {
-	exchange.logf(LogLevelInfo, "> %v %v %v %v", len(m.Body), m.TimeoutSeconds, m.ToAddress, m.ReplyAddress)
+func (shard *exchangeShard) timeoutReadyState(rs *readyState) {
+	shard.logf(LogLevelDebug, "* ready timeout %v", strings.Join(rs.onAddresses, " "))
+	shard.unqueueReadyState(rs)
+	if shard.claim(rs) {
+		shard.timeoutCount++
+		rs.waiter.messageChan <- nil
+	}
+}
+
+func (shard *exchangeShard) handleMessage(m Message) {
+	shard.messageCounter += shard.stride
+	m.id = shard.messageCounter
+	shard.sentCount++
+	
+	shard.logf(LogLevelInfo, "> %v %v %v %v", len(m.Body), FormatMillis(m.TimeoutMillis), m.ToAddress, m.ReplyAddress)
+	
+	if m.notBefore > time.Nanoseconds() {
+		shard.logf(LogLevelInfo, "  delayed")
+		
+		if shard.journal != nil {
+			shard.journalError(shard.journal.enqueued(&m))
+		}
+		
+		shard.delayMessage(m)
+		return
+	}
 	
-	if readyStateQueue, exists := exchange.readyStateQueues[m.ToAddress]; exists {
-		exchange.logf(LogLevelInfo, "  delivered")
+	shard.dispatchMessage(m, false)
+}
+
+// dispatchMessage hands m to a waiting ready state, or queues it if there
+// is none. journaled reports whether m was already recorded in the journal
+// when it was delayed.
+func (shard *exchangeShard) dispatchMessage(m Message, journaled bool) {
+	if m.Fanout || shard.fanoutAddresses[m.ToAddress] {
+		shard.broadcastMessage(m)
 		
-		rs := readyStateQueue.At(0).(*readyState)
-		rs.messageChan <- m
-		exchange.unqueueReadyState(rs)		
+		if journaled && shard.journal != nil {
+			shard.journalError(shard.journal.delivered(m.id))
+		}
+		return
+	}
+	
+	if rs := shard.claimReadyState(m.ToAddress); rs != nil {
+		shard.logf(LogLevelInfo, "  delivered")
+		shard.deliverMessage(rs, m, journaled)
 	} else {
-		exchange.logf(LogLevelInfo, "  queued")
+		shard.logf(LogLevelInfo, "  queued")
+		
+		if !journaled && shard.journal != nil {
+			shard.journalError(shard.journal.enqueued(&m))
+		}
+		
+		shard.queueMessage(m)
+	}
+}
+
+// deliverMessage hands m to rs, which must be claimed and no longer
+// queued. journaled reports whether m has an enqueue record in the journal.
+func (shard *exchangeShard) deliverMessage(rs *readyState, m Message, journaled bool) {
+	rs.waiter.messageChan <- []Message{shard.handOver(rs, m, journaled)}
+}
+
+// handOver records that m is being delivered to rs and returns m as rs
+// should receive it. If rs asked for acknowledged delivery, m stays in
+// flight, and in the journal, until it is acked.
+func (shard *exchangeShard) handOver(rs *readyState, m Message, journaled bool) Message {
+	shard.deliveredCount++
 	
-		if exchange.messageQueues[m.ToAddress] == nil {
-			exchange.messageQueues[m.ToAddress] = new(vector.Vector)
+	if rs.ackTimeout == 0 {
+		if journaled && shard.journal != nil {
+			shard.journalError(shard.journal.delivered(m.id))
 		}
-		exchange.messageQueues[m.ToAddress].Push(m)
+		return m
 	}
+	
+	if !journaled && shard.journal != nil {
+		shard.journalError(shard.journal.enqueued(&m))
+	}
+	
+	shard.deliveryCounter += shard.stride
+	deliveryId := fmt.Sprintf("%X", shard.deliveryCounter)
+	shard.inFlight[deliveryId] = &inFlightMessage{m, shard.addDeadline(time.Nanoseconds() + rs.ackTimeout, func() {
+		shard.logf(LogLevelInfo, "! %v ack timeout", deliveryId)
+		shard.requeueInFlight(deliveryId)
+	})}
+	
+	m.DeliveryId = deliveryId
+	return m
 }
 
-func (exchange *Exchange) handleUnusedAddressReq(replyChan chan string) {
-	exchange.unusedAddressCounter++
-	replyChan <- fmt.Sprintf("%X.%X", time.Seconds(), exchange.unusedAddressCounter)
+type inFlightMessage struct {
+	message  Message
+	deadline *deadline
 }
 
-func (exchange *Exchange) handleTick(t int64) {
-	removeTheseUnreadyQueues := new (vector.StringVector)
-	for toAddress, messageQueue := range(exchange.messageQueues) {
-		for i := 0; i < messageQueue.Len(); i++ {
-			msg := messageQueue.At(i).(Message)
-			if msg.timeout < t {
-				exchange.logf(LogLevelDebug, "> %v %v %v %v", len(msg.Body), msg.TimeoutSeconds, msg.ToAddress, msg.ReplyAddress)
-				exchange.logf(LogLevelDebug, "  send timeout")
-				messageQueue.Delete(i)
-				i--
+// removeInFlight stops tracking the in-flight message with deliveryId and
+// returns it.
+func (shard *exchangeShard) removeInFlight(deliveryId string) Message {
+	f := shard.inFlight[deliveryId]
+	shard.inFlight[deliveryId] = nil, false
+	shard.removeDeadline(f.deadline)
+	return f.message
+}
+
+const (
+	ackDelivered = iota
+	ackRequeue
+	ackReject
+)
+
+type ackRequest struct {
+	deliveryId string
+	action     int
+}
+
+func (shard *exchangeShard) handleAck(a ackRequest) {
+	if _, exists := shard.inFlight[a.deliveryId]; !exists {
+		// it was already acked, or has been requeued
+		return
+	}
+	
+	switch a.action {
+	case ackRequeue:
+		shard.logf(LogLevelInfo, "! %v requeue", a.deliveryId)
+		shard.requeueInFlight(a.deliveryId)
+	
+	case ackReject:
+		shard.logf(LogLevelInfo, "! %v reject", a.deliveryId)
+		m := shard.removeInFlight(a.deliveryId)
+		if shard.journal != nil {
+			shard.journalError(shard.journal.expired(m.id))
+		}
+		shard.deadLetter(m, ReasonRejected)
+	
+	default:
+		shard.logf(LogLevelInfo, "! %v", a.deliveryId)
+		m := shard.removeInFlight(a.deliveryId)
+		if shard.journal != nil {
+			shard.journalError(shard.journal.delivered(m.id))
+		}
+	}
+}
+
+// requeueInFlight puts an unacknowledged message back on its original
+// address, where it keeps its place in line.
+func (shard *exchangeShard) requeueInFlight(deliveryId string) {
+	shard.redeliver(shard.removeInFlight(deliveryId), true)
+}
+
+// handleReturn puts back a message that was handed to a client without
+// acknowledgement but never reached it.
+func (shard *exchangeShard) handleReturn(m Message) {
+	shard.redeliver(m, false)
+}
+
+// redeliver puts m back on its address, where it keeps its place in line.
+// journaled reports whether m still has an enqueue record in the journal.
+// A broadcast copy is dropped, as it would have been with nobody there to
+// receive it.
+func (shard *exchangeShard) redeliver(m Message, journaled bool) {
+	shard.logf(LogLevelInfo, "> %v %v %v %v", len(m.Body), FormatMillis(m.TimeoutMillis), m.ToAddress, m.ReplyAddress)
+	
+	if m.timeout <= time.Nanoseconds() {
+		if journaled {
+			shard.expireMessage(m)
+		} else {
+			shard.expiredCount++
+			shard.deadLetter(m, ReasonExpired)
+		}
+		return
+	}
+	
+	if m.broadcastCopy || shard.fanoutAddresses[m.ToAddress] {
+		shard.logf(LogLevelInfo, "  broadcast copy dropped")
+		if journaled && shard.journal != nil {
+			shard.journalError(shard.journal.delivered(m.id))
+		}
+		return
+	}
+	
+	shard.logf(LogLevelInfo, "  requeued")
+	shard.dispatchMessage(m, journaled)
+}
+
+// delayMessage holds m until its notBefore time, keeping the delayed
+// messages in the order they become deliverable.
+func (shard *exchangeShard) delayMessage(m Message) {
+	i := shard.delayedMessages.Len()
+	for i > 0 && m.notBefore < shard.delayedMessages.At(i-1).(Message).notBefore {
+		i--
+	}
+	shard.delayedMessages.Insert(i, m)
+	
+	shard.addDeadline(m.notBefore, func() {
+		shard.releaseDelayed()
+	})
+}
+
+// releaseDelayed dispatches the delayed messages whose time has come.
+func (shard *exchangeShard) releaseDelayed() {
+	now := time.Nanoseconds()
+	for shard.delayedMessages.Len() > 0 && shard.delayedMessages.At(0).(Message).notBefore <= now {
+		m := shard.delayedMessages.At(0).(Message)
+		shard.delayedMessages.Delete(0)
+		
+		shard.logf(LogLevelInfo, "> %v %v %v %v", len(m.Body), FormatMillis(m.TimeoutMillis), m.ToAddress, m.ReplyAddress)
+		shard.logf(LogLevelInfo, "  released")
+		shard.dispatchMessage(m, true)
+	}
+}
+
+// broadcastMessage hands a copy of m to every ready state waiting on its
+// address and queues a copy on the queue address of every subscriber.
+// With nobody listening and no subscribers, the message is dropped.
+func (shard *exchangeShard) broadcastMessage(m Message) {
+	m.Fanout = false
+	copies := 0
+	
+	for rs := shard.claimReadyState(m.ToAddress); rs != nil; rs = shard.claimReadyState(m.ToAddress) {
+		// each copy is tracked separately if it ends up in flight
+		readerCopy := m
+		readerCopy.broadcastCopy = true
+		shard.messageCounter += shard.stride
+		readerCopy.id = shard.messageCounter
+		
+		shard.deliverMessage(rs, readerCopy, false)
+		copies++
+	}
+	
+	if queueAddresses, exists := shard.subscribers[m.ToAddress]; exists {
+		for i := 0; i < queueAddresses.Len(); i++ {
+			if queueAddresses.At(i) == m.ToAddress {
+				continue
 			}
+			
+			subscriberCopy := m
+			subscriberCopy.ToAddress = queueAddresses.At(i)
+			shard.route(subscriberCopy)
+			copies++
 		}
-		if messageQueue.Len() == 0 {
-			removeTheseUnreadyQueues.Push(toAddress)
+	}
+	
+	shard.logf(LogLevelInfo, "  broadcast to %v", copies)
+}
+
+func (shard *exchangeShard) queueMessage(m Message) {
+	messageQueue := shard.messageQueues[m.ToAddress]
+	if messageQueue == nil {
+		messageQueue = new(vector.Vector)
+		shard.messageQueues[m.ToAddress] = messageQueue
+	}
+	
+	address, id := m.ToAddress, m.id
+	m.deadline = shard.addDeadline(m.timeout, func() {
+		shard.expireQueued(address, id)
+	})
+	
+	// keep the queue in delivery order, which is usually just the end
+	i := messageQueue.Len()
+	for i > 0 && queuedBefore(m, messageQueue.At(i-1).(Message)) {
+		i--
+	}
+	messageQueue.Insert(i, m)
+	
+	shard.queueBytes[m.ToAddress] += len(m.Body)
+	if shard.reservedCount > 0 {
+		shard.reservedCount--
+		shard.reservedBytes -= len(m.Body)
+	} else {
+		shard.totals.add(1, len(m.Body))
+	}
+}
+
+// removeQueued removes and returns the message at index i of the queue on
+// address, removing the queue once it is empty.
+func (shard *exchangeShard) removeQueued(address string, i int) Message {
+	messageQueue := shard.messageQueues[address]
+	m := messageQueue.At(i).(Message)
+	messageQueue.Delete(i)
+	
+	shard.removeDeadline(m.deadline)
+	m.deadline = nil
+	
+	if shard.totals.add(-1, -len(m.Body)) {
+		shard.exchange.wakeShards()
+	}
+	
+	if messageQueue.Len() == 0 {
+		shard.messageQueues[address] = nil, false
+		shard.queueBytes[address] = 0, false
+	} else {
+		shard.queueBytes[address] -= len(m.Body)
+	}
+	
+	return m
+}
+
+// queuedBefore reports whether a should be delivered before b: higher
+// priorities first, and the order they were sent within a priority.
+func queuedBefore(a Message, b Message) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.id < b.id
+}
+
+// expireQueued expires the message with id on the queue on address.
+func (shard *exchangeShard) expireQueued(address string, id uint64) {
+	messageQueue := shard.messageQueues[address]
+	for i := 0; i < messageQueue.Len(); i++ {
+		if messageQueue.At(i).(Message).id == id {
+			shard.expireMessage(shard.removeQueued(address, i))
+			return
 		}
 	}
-	for i := 0; i < removeTheseUnreadyQueues.Len(); i++ {
-		exchange.messageQueues[removeTheseUnreadyQueues.At(i)] = nil, false
+}
+
+func (shard *exchangeShard) expireMessage(m Message) {
+	shard.logf(LogLevelDebug, "> %v %v %v %v", len(m.Body), FormatMillis(m.TimeoutMillis), m.ToAddress, m.ReplyAddress)
+	shard.logf(LogLevelDebug, "  send timeout")
+	shard.expiredCount++
+	if shard.journal != nil {
+		shard.journalError(shard.journal.expired(m.id))
 	}
+	shard.deadLetter(m, ReasonExpired)
+}
 
-	removeTheseReadyStates := new(vector.StringVector)
-	for onAddress, readyStateQueue := range(exchange.readyStateQueues) {
-		for i := 0; i < readyStateQueue.Len(); i++ {
-			readyState := readyStateQueue.At(i).(*readyState)
-			if readyState.timeout < t {
-				exchange.logf(LogLevelDebug, "* ready timeout %v", onAddress)
-				if !readyState.timeoutReceived {
-					readyState.messageChan <- Message{"", "", 0, "", 0}
-					readyState.timeoutReceived = true
-				}
-				readyStateQueue.Delete(i)
-				i--
+// deadLetter moves m to the dead-letter address for its address, if there
+// is one, after sending an expiry notice if m asked for one.
+func (shard *exchangeShard) deadLetter(m Message, reason string) {
+	shard.notifyExpiry(m, reason)
+	
+	deadLetterAddress, exists := shard.deadLetterAddresses[m.ToAddress]
+	if !exists {
+		deadLetterAddress = shard.deadLetterAddress
+	}
+	
+	if deadLetterAddress == "" || deadLetterAddress == m.ToAddress {
+		return
+	}
+	
+	shard.logf(LogLevelInfo, "  moved to %v (%v)", deadLetterAddress, reason)
+	
+	deadLetter := Message{
+		ToAddress:       deadLetterAddress,
+		ReplyAddress:    m.ReplyAddress,
+		TimeoutMillis:   shard.deadLetterTimeout,
+		Body:            m.Body,
+		Priority:        m.Priority,
+		Headers:         m.Headers,
+		OriginalAddress: m.ToAddress,
+		Reason:          reason,
+	}
+	deadLetter.notBefore = time.Nanoseconds()
+	deadLetter.timeout = deadLetter.notBefore + (deadLetter.TimeoutMillis * 1e6)
+	
+	shard.route(deadLetter)
+}
+
+// notifyExpiry tells m's sender that m was given up on for reason, if m
+// asked for that with NotifyExpiry. The notice is sent to m's reply
+// address, with no body, and with reason and m's address as its Reason and
+// OriginalAddress.
+func (shard *exchangeShard) notifyExpiry(m Message, reason string) {
+	if !m.NotifyExpiry || m.ReplyAddress == "" {
+		return
+	}
+	
+	shard.logf(LogLevelInfo, "  %v notified (%v)", m.ReplyAddress, reason)
+	
+	notice := Message{
+		ToAddress:       m.ReplyAddress,
+		TimeoutMillis:   expiryNoticeTimeout,
+		OriginalAddress: m.ToAddress,
+		Reason:          reason,
+	}
+	notice.notBefore = time.Nanoseconds()
+	notice.timeout = notice.notBefore + (notice.TimeoutMillis * 1e6)
+	
+	shard.route(notice)
+}
+
+type subscription struct {
+	toAddress    string
+	queueAddress string
+	subscribe    bool
+}
+
+func (shard *exchangeShard) handleSubscription(s subscription) {
+	shard.logf(LogLevelInfo, "+ %v %v %v", s.toAddress, s.queueAddress, s.subscribe)
+	
+	if !updateSubscribers(shard.subscribers, s.toAddress, s.queueAddress, s.subscribe) {
+		return
+	}
+	
+	if shard.journal != nil {
+		shard.journalError(shard.journal.subscribed(s.toAddress, s.queueAddress, s.subscribe))
+	}
+}
+
+// updateSubscribers adds or removes queueAddress from the subscribers of
+// toAddress and reports whether anything changed.
+func updateSubscribers(subscribers map [string] *vector.StringVector, toAddress string, queueAddress string, subscribe bool) bool {
+	queueAddresses := subscribers[toAddress]
+	
+	index := -1
+	if queueAddresses != nil {
+		for i := 0; i < queueAddresses.Len(); i++ {
+			if queueAddresses.At(i) == queueAddress {
+				index = i
+				break
 			}
 		}
-		if readyStateQueue.Len() == 0 {
-			removeTheseReadyStates.Push(onAddress)
+	}
+	
+	if subscribe {
+		if index >= 0 {
+			return false
+		}
+		if queueAddresses == nil {
+			queueAddresses = new(vector.StringVector)
+			subscribers[toAddress] = queueAddresses
+		}
+		queueAddresses.Push(queueAddress)
+	} else {
+		if index < 0 {
+			return false
+		}
+		queueAddresses.Delete(index)
+		if queueAddresses.Len() == 0 {
+			subscribers[toAddress] = nil, false
 		}
 	}
-	for i := 0; i < removeTheseReadyStates.Len(); i++ {
-		exchange.readyStateQueues[removeTheseReadyStates.At(i)] = nil, false
+	
+	return true
+}
+
+func (shard *exchangeShard) journalError(err os.Error) {
+	if err != nil {
+		shard.logf(LogLevelMinimal, "journal write failed: %v", err)
 	}
 }
 
+// snapshot adds the messages that are currently queued, delayed or in
+// flight on this shard, and its subscribers, to state.
+func (shard *exchangeShard) snapshot(state *journalState) {
+	for _, messageQueue := range(shard.messageQueues) {
+		for i := 0; i < messageQueue.Len(); i++ {
+			state.messages = appendMessage(state.messages, messageQueue.At(i).(Message))
+		}
+	}
+	for i := 0; i < shard.delayedMessages.Len(); i++ {
+		state.messages = appendMessage(state.messages, shard.delayedMessages.At(i).(Message))
+	}
+	for _, f := range(shard.inFlight) {
+		state.messages = appendMessage(state.messages, f.message)
+	}
+	
+	for toAddress, queueAddresses := range(shard.subscribers) {
+		state.subscribers[toAddress] = queueAddresses
+	}
+}
+
+// GenerateUnusedAddress returns a new random address, which can't be
+// guessed by other clients and isn't matched by any pattern.
 func (exchange *Exchange) GenerateUnusedAddress() string {
-	replyAddrChan := make(chan string)
-	exchange.unusedAddressReqChan <- replyAddrChan
-	return <- replyAddrChan
+	b := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		panic(fmt.Sprintf("unable to generate address: %v", err))
+	}
+	return fmt.Sprintf("%v%x", generatedAddressPrefix, b)
+}
+
+func (exchange *Exchange) Send(body []byte, timeoutMillis int64, toAddress string, replyAddress string) os.Error {
+	return exchange.SendMessage(&Message{ToAddress: toAddress, ReplyAddress: replyAddress, TimeoutMillis: timeoutMillis, Body: body})
 }
 
-func (exchange *Exchange) Send(body string, timeoutSeconds int64, toAddress string, replyAddress string) {
-	exchange.messageChan <- Message{toAddress, replyAddress, timeoutSeconds, body, time.Nanoseconds() + (timeoutSeconds * 1e9)}
+// SendMessage sends a copy of msg, honoring any options set on it, such as
+// Priority, to the address its ToAddress is routed to, if it has a Route.
+// A message with DelayMillis or NotBefore (in seconds since the epoch) set
+// is held until then, and its timeout starts from that time. An error is
+// returned if the message is turned away because its queue is full.
+//
+// A Mandatory message is only sent if a client is waiting to receive it
+// (or, when broadcast, if its address has subscribers), and ErrNoListener
+// is returned otherwise. Setting MandatoryWaitMillis waits up to that long
+// for a listener to turn up before giving up, and implies Mandatory. A
+// mandatory message can't be delayed.
+func (exchange *Exchange) SendMessage(msg *Message) os.Error {
+	m, err := prepareMessage(msg)
+	if err != nil {
+		return err
+	}
+	m.ToAddress = exchange.resolve(m.ToAddress)
+	
+	req := &sendRequest{m, make(chan os.Error, 1), nil}
+	exchange.shardFor(m.ToAddress).messageChan <- req
+	return <-req.replyChan
+}
+
+// prepareMessage checks msg and returns a copy of it ready to be handled by
+// a shard, with its delay and timeout worked out.
+func prepareMessage(msg *Message) (Message, os.Error) {
+	err := checkHeaders(msg.Headers)
+	if err != nil {
+		return Message{}, err
+	}
+	
+	if (msg.Mandatory || msg.MandatoryWaitMillis > 0) && (msg.DelayMillis != 0 || msg.NotBefore != 0) {
+		return Message{}, os.NewError("mandatory messages can't be delayed")
+	}
+	
+	m := *msg
+	m.notBefore = time.Nanoseconds() + (m.DelayMillis * 1e6)
+	if m.NotBefore * 1e9 > m.notBefore {
+		m.notBefore = m.NotBefore * 1e9
+	}
+	m.DelayMillis = 0
+	m.NotBefore = 0
+	m.Mandatory = m.Mandatory || m.MandatoryWaitMillis > 0
+	m.timeout = m.notBefore + (m.TimeoutMillis * 1e6)
+	return m, nil
+}
+
+// Broadcast sends a copy of body to every client currently waiting on
+// toAddress and to every subscriber of toAddress.
+func (exchange *Exchange) Broadcast(body []byte, timeoutMillis int64, toAddress string, replyAddress string) os.Error {
+	return exchange.SendMessage(&Message{ToAddress: toAddress, ReplyAddress: replyAddress, TimeoutMillis: timeoutMillis, Body: body, Fanout: true})
+}
+
+// Subscribe registers queueAddress as a durable subscriber of toAddress.
+// Every message broadcast to toAddress is queued on queueAddress, whether
+// or not anyone is waiting there at the time.
+func (exchange *Exchange) Subscribe(toAddress string, queueAddress string) {
+	exchange.shardFor(toAddress).subscriptionChan <- subscription{toAddress, queueAddress, true}
+}
+
+func (exchange *Exchange) Unsubscribe(toAddress string, queueAddress string) {
+	exchange.shardFor(toAddress).subscriptionChan <- subscription{toAddress, queueAddress, false}
+}
+
+func (exchange *Exchange) Query(body []byte, timeoutMillis int64, toAddress string) *Message {
+	return exchange.QueryMessage(&Message{ToAddress: toAddress, TimeoutMillis: timeoutMillis, Body: body})
+}
+
+// QueryMessage sends a copy of msg with a newly generated reply address
+// and waits for the reply. It returns nil if the query times out or is
+// turned away because its queue is full. If msg has NotifyExpiry set and
+// is given up on before it is answered, the notice is returned instead.
+func (exchange *Exchange) QueryMessage(msg *Message) *Message {
+	return exchange.QueryCancel(msg, nil)
+}
+
+// QueryCancel is like QueryMessage, but stops waiting for the reply and
+// returns nil as soon as cancelChan receives.
+func (exchange *Exchange) QueryCancel(msg *Message, cancelChan <-chan bool) *Message {
+	return exchange.query(msg, exchange.GenerateUnusedAddress(), cancelChan)
+}
+
+// query sends a copy of msg with replyAddress and waits for the reply.
+func (exchange *Exchange) query(msg *Message, replyAddress string, cancelChan <-chan bool) *Message {
+	m := *msg
+	m.ReplyAddress = replyAddress
+	if !awaitsReply(&m, exchange.SendMessage(&m)) {
+		return nil
+	}
+	return exchange.ReadyCancel(replyTimeout(&m), []string{m.ReplyAddress}, 0, cancelChan)
 }
 
-func (exchange *Exchange) Query(body string, timeoutSeconds int64, toAddress string) *Message {
-	replyAddr := exchange.GenerateUnusedAddress()
-	exchange.messageChan <- Message{toAddress, replyAddr, timeoutSeconds, body, time.Nanoseconds() + (timeoutSeconds * 1e9)}
-	return exchange.Ready(timeoutSeconds, []string{replyAddr})
+// awaitsReply reports whether a query for m, whose send returned err, has
+// something to wait for: either m was sent, or it was turned away because
+// its queue was full and the expiry notice it asked for is on its way.
+func awaitsReply(m *Message, err os.Error) bool {
+	if err == nil {
+		return true
+	}
+	_, queueFull := err.(*queueFullError)
+	return queueFull && m.NotifyExpiry
 }
 
-func (exchange *Exchange) Ready(timeoutSeconds int64, onAddresses []string) *Message {
-	rs := new(readyState)
-	for i := 0; i < len(onAddresses); i++ {
-		rs.onAddresses[i] = onAddresses[i]
+// replyTimeout returns how long a query for msg waits for its reply.
+func replyTimeout(msg *Message) int64 {
+	if msg.NotifyExpiry {
+		return msg.TimeoutMillis + expiryNoticeGrace
 	}
-	rs.onAddressCount = len(onAddresses)
-	rs.timeout = time.Nanoseconds() + (timeoutSeconds * 1e9)
-	messageChan := make(chan Message)
-	rs.messageChan = messageChan
+	return msg.TimeoutMillis
+}
 
-	exchange.readyStateChan <- rs
-	replyMsg := <-messageChan
-	if replyMsg.ToAddress == "" {
+// QueryAll sends a copy of msg to each of toAddresses, all with the same
+// newly generated reply address, and gathers the replies. It returns once
+// every address has answered, once quorum replies have arrived if quorum
+// is more than zero, or when the query times out, with whatever replies
+// have arrived. A copy sent to a fan-out address may be answered by any
+// number of listeners, so unless quorum is reached, a query that includes
+// one always waits for the timeout. Copies turned away because their queue
+// is full aren't waited for, unless msg has NotifyExpiry set, when their
+// notices are gathered along with the replies.
+func (exchange *Exchange) QueryAll(msg *Message, toAddresses []string, quorum int) []*Message {
+	return exchange.QueryAllCancel(msg, toAddresses, quorum, nil)
+}
+
+// QueryAllCancel is like QueryAll, but stops gathering and returns the
+// replies so far as soon as cancelChan receives or is closed.
+func (exchange *Exchange) QueryAllCancel(msg *Message, toAddresses []string, quorum int, cancelChan <-chan bool) []*Message {
+	return exchange.queryAll(msg, toAddresses, quorum, exchange.GenerateUnusedAddress(), cancelChan)
+}
+
+// queryAll sends a copy of msg to each of toAddresses with replyAddress and
+// gathers the replies.
+func (exchange *Exchange) queryAll(msg *Message, toAddresses []string, quorum int, replyAddress string, cancelChan <-chan bool) []*Message {
+	deadline := time.Nanoseconds() + (replyTimeout(msg) * 1e6)
+	
+	sent := 0
+	fanout := false
+	for _, toAddress := range toAddresses {
+		m := *msg
+		m.ToAddress = toAddress
+		m.ReplyAddress = replyAddress
+		if !awaitsReply(&m, exchange.SendMessage(&m)) {
+			continue
+		}
+		
+		sent++
+		if m.Fanout || exchange.isFanout(toAddress) {
+			fanout = true
+		}
+	}
+	
+	// want is how many replies to wait for, or -1 to wait for the timeout
+	want := sent
+	if fanout {
+		want = -1
+	}
+	if quorum > 0 && (want < 0 || quorum < want) {
+		want = quorum
+	}
+	
+	replies := make([]*Message, 0, sent)
+	for sent > 0 && (want < 0 || len(replies) < want) {
+		remaining := (deadline - time.Nanoseconds()) / 1e6
+		if remaining <= 0 {
+			break
+		}
+		
+		count := want - len(replies)
+		if want < 0 {
+			count = defaultGatherBatch
+		}
+		
+		batch := exchange.ReadyBatchWith(remaining, []string{replyAddress}, count, new(ReadyOptions), cancelChan)
+		if len(batch) == 0 {
+			// timed out or cancelled
+			break
+		}
+		
+		for _, reply := range batch {
+			if len(replies) == cap(replies) {
+				newReplies := make([]*Message, len(replies), 2 * len(replies) + 1)
+				copy(newReplies, replies)
+				replies = newReplies
+			}
+			replies = replies[0:len(replies)+1]
+			replies[len(replies)-1] = reply
+		}
+	}
+	
+	return replies
+}
+
+// isFanout reports whether address was marked fan-out with SetFanout,
+// which is only called before Start.
+func (exchange *Exchange) isFanout(address string) bool {
+	return exchange.shardFor(address).fanoutAddresses[address]
+}
+
+// Ready waits up to timeoutMillis for a message on any of onAddresses, and
+// returns nil if none arrives.
+func (exchange *Exchange) Ready(timeoutMillis int64, onAddresses []string) *Message {
+	return exchange.ReadyAck(timeoutMillis, onAddresses, 0)
+}
+
+// ReadyAck is like Ready, but unless ackTimeoutMillis is zero, the message
+// it returns carries a DeliveryId and stays in flight until it is passed to
+// Ack. If that doesn't happen within ackTimeoutMillis, or the message is
+// passed to Requeue instead, it is queued again on its original address.
+func (exchange *Exchange) ReadyAck(timeoutMillis int64, onAddresses []string, ackTimeoutMillis int64) *Message {
+	return exchange.ReadyCancel(timeoutMillis, onAddresses, ackTimeoutMillis, nil)
+}
+
+// ReadyCancel is like ReadyAck, but gives up and returns nil as soon as
+// cancelChan receives, withdrawing from the exchange so no message is
+// handed to it. If a message arrives at the same moment, it is returned
+// anyway.
+func (exchange *Exchange) ReadyCancel(timeoutMillis int64, onAddresses []string, ackTimeoutMillis int64, cancelChan <-chan bool) *Message {
+	return exchange.ReadyWith(timeoutMillis, onAddresses, &ReadyOptions{AckTimeoutMillis: ackTimeoutMillis}, cancelChan)
+}
+
+// ReadyOptions change how Ready picks a message.
+//
+// AckTimeoutMillis works as in ReadyAck.
+//
+// Ready normally takes from the first of its addresses that has a message
+// waiting, so a busy first address starves the rest. With Fair set, it
+// takes turns between the addresses that have messages waiting instead,
+// and Weights, if set, gives each address that many turns for every one
+// turn of an address with weight 1. Setting Weights implies Fair. Turns
+// are shared by every fair Ready on the same addresses with the same
+// weights, whichever shards own the addresses.
+type ReadyOptions struct {
+	AckTimeoutMillis int64
+	Fair             bool
+	Weights          []int
+}
+
+// ReadyWith is like ReadyCancel, with options. It panics if Weights is set
+// and doesn't hold a positive weight for each of onAddresses.
+func (exchange *Exchange) ReadyWith(timeoutMillis int64, onAddresses []string, options *ReadyOptions, cancelChan <-chan bool) *Message {
+	messages := exchange.ReadyBatchWith(timeoutMillis, onAddresses, 1, options, cancelChan)
+	if len(messages) == 0 {
 		return nil
 	}
-	return &replyMsg
+	return messages[0]
+}
+
+// ReadyBatch is like Ready, but returns up to count messages at once. If
+// messages are already queued, it returns as many as it can without
+// waiting. Otherwise it waits for the first one, and returns it alone.
+// When waiting on addresses owned by more than one shard, the batch comes
+// from a single shard. It returns an empty slice if the Ready times out.
+func (exchange *Exchange) ReadyBatch(timeoutMillis int64, onAddresses []string, count int) []*Message {
+	return exchange.ReadyBatchWith(timeoutMillis, onAddresses, count, new(ReadyOptions), nil)
+}
+
+// ReadyBatchWith is like ReadyBatch, with options and a cancelChan that
+// work as they do for ReadyWith.
+func (exchange *Exchange) ReadyBatchWith(timeoutMillis int64, onAddresses []string, count int, options *ReadyOptions, cancelChan <-chan bool) []*Message {
+	if count < 1 {
+		count = 1
+	}
+	
+	weights := options.Weights
+	if weights == nil && options.Fair {
+		weights = make([]int, len(onAddresses))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	if weights != nil && len(weights) != len(onAddresses) {
+		panic("msglite: ReadyWith needs a weight for each address")
+	}
+	
+	now := time.Nanoseconds()
+	timeout := now + (timeoutMillis * 1e6)
+	ackTimeout := options.AckTimeoutMillis * 1e6
+	
+	w := exchange.newWaiter(onAddresses, weights, count, timeout, ackTimeout)
+	if weights != nil && len(w.readyStates) > 1 {
+		// no one shard sees every address, so the turn is taken here, and
+		// the Ready then prefers the address whose turn it is
+		best := exchange.pickScheduled(onAddresses, weights, w.probe(len(onAddresses)), now)
+		w = exchange.newWaiter(preferring(onAddresses, best), nil, count, timeout, ackTimeout)
+	}
+	w.place()
+	
+	var replyMessages []Message
+	select {
+	case replyMessages = <-w.messageChan:
+	case <-cancelChan:
+		if w.cancel() {
+			return nil
+		}
+		replyMessages = <-w.messageChan
+	}
+	
+	messages := make([]*Message, len(replyMessages))
+	for i := range replyMessages {
+		messages[i] = &replyMessages[i]
+	}
+	return messages
+}
+
+// returnMessage puts back a message returned by Ready that never reached
+// the client it was meant for. Messages received through ReadyAck are put
+// back with Requeue instead.
+func (exchange *Exchange) returnMessage(msg *Message) {
+	exchange.shardFor(msg.ToAddress).returnChan <- *msg
+}
+
+// Ack acknowledges a message received through ReadyAck.
+func (exchange *Exchange) Ack(deliveryId string) {
+	exchange.deliveryShard(deliveryId).ackChan <- ackRequest{deliveryId, ackDelivered}
+}
+
+// Requeue gives up on a message received through ReadyAck, queueing it
+// again without waiting for its ack timeout.
+func (exchange *Exchange) Requeue(deliveryId string) {
+	exchange.deliveryShard(deliveryId).ackChan <- ackRequest{deliveryId, ackRequeue}
+}
+
+// Reject gives up on a message received through ReadyAck for good, moving
+// it to its dead-letter address if it has one.
+func (exchange *Exchange) Reject(deliveryId string) {
+	exchange.deliveryShard(deliveryId).ackChan <- ackRequest{deliveryId, ackReject}
 }
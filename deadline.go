@@ -0,0 +1,104 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"container/heap"
+	"container/vector"
+	"time"
+)
+
+// A deadline calls fire once the time at has passed, unless it is removed
+// first. Queued messages, delayed messages, waiting ready states, messages
+// in flight and blocked senders each get one, so each shard can sleep
+// until exactly the next thing it needs to do.
+type deadline struct {
+	at    int64
+	index int
+	fire  func()
+}
+
+// deadlineHeap keeps the earliest deadline at index 0, and keeps each
+// deadline's index up to date so it can be removed early.
+type deadlineHeap struct {
+	vector.Vector
+}
+
+func (h *deadlineHeap) Less(i, j int) bool {
+	return h.At(i).(*deadline).at < h.At(j).(*deadline).at
+}
+
+func (h *deadlineHeap) Swap(i, j int) {
+	h.Vector.Swap(i, j)
+	h.At(i).(*deadline).index = i
+	h.At(j).(*deadline).index = j
+}
+
+func (h *deadlineHeap) Push(x interface{}) {
+	x.(*deadline).index = h.Len()
+	h.Vector.Push(x)
+}
+
+func (h *deadlineHeap) Pop() interface{} {
+	d := h.Vector.Pop().(*deadline)
+	d.index = -1
+	return d
+}
+
+// addDeadline arranges for fire to be called from the shard's goroutine
+// once the time at (in nanoseconds) has passed.
+func (shard *exchangeShard) addDeadline(at int64, fire func()) *deadline {
+	d := &deadline{at, -1, fire}
+	heap.Push(shard.deadlines, d)
+	return d
+}
+
+// removeDeadline cancels d. It does nothing if d is nil or has already
+// fired or been removed.
+func (shard *exchangeShard) removeDeadline(d *deadline) {
+	if d != nil && d.index >= 0 {
+		heap.Remove(shard.deadlines, d.index)
+	}
+}
+
+// handleDeadlines fires every deadline that has passed, earliest first.
+func (shard *exchangeShard) handleDeadlines() {
+	shard.timer = nil
+
+	now := time.Nanoseconds()
+	for shard.deadlines.Len() > 0 && shard.deadlines.At(0).(*deadline).at <= now {
+		heap.Pop(shard.deadlines).(*deadline).fire()
+	}
+}
+
+// deadlineTimer returns a channel that receives when the earliest deadline
+// arrives, or nil if there are none. The timer is only replaced when the
+// earliest deadline changes.
+func (shard *exchangeShard) deadlineTimer() <-chan int64 {
+	if shard.deadlines.Len() == 0 {
+		if shard.timer != nil {
+			shard.timer.Stop()
+			shard.timer = nil
+		}
+		return nil
+	}
+
+	next := shard.deadlines.At(0).(*deadline).at
+	if shard.timer != nil && shard.timerAt == next {
+		return shard.timer.C
+	}
+
+	if shard.timer != nil {
+		shard.timer.Stop()
+	}
+
+	wait := next - time.Nanoseconds()
+	if wait < 0 {
+		wait = 0
+	}
+	shard.timer = time.NewTimer(wait)
+	shard.timerAt = next
+	return shard.timer.C
+}
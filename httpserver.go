@@ -10,15 +10,32 @@ import (
 	"json"
 	"net"
 	"os"
+	"strings"
 )
 
-const httpTimeout = 180
+const httpTimeout = 180 * 1000
+
+// With SetRequestHeaders, requests are relayed with these message headers
+// as well as the JSON envelope, and each HTTP header is passed along with
+// httpHeaderPrefix in front of its name. Workers that predate headers
+// can't read such messages, so it is off by default. Any worker may reply
+// by setting statusHeader, and prefixed headers for the response, instead
+// of sending a JSON envelope.
+const (
+	methodHeader      = "Method"
+	urlHeader         = "Url"
+	protocolHeader    = "Protocol"
+	bodyAddressHeader = "Body-Address"
+	statusHeader      = "Status"
+	httpHeaderPrefix  = "Http-"
+)
 
 type HttpServer struct {
 	exchange *Exchange
 	exchangeToAddress string
 	listener net.Listener
 	quitChan chan bool
+	requestHeaders bool
 }
 
 func NewHttpServer(exchange *Exchange, network string, laddr string, exchangeToAddress string) (server *HttpServer) {
@@ -66,6 +83,12 @@ func (server *HttpServer) Run() {
 	}
 }
 
+// SetRequestHeaders makes relayed requests carry the request line and HTTP
+// headers as message headers too. It must be called before Run.
+func (server *HttpServer) SetRequestHeaders(requestHeaders bool) {
+	server.requestHeaders = requestHeaders
+}
+
 func (server *HttpServer) Quit() {
 	server.quitChan <- true
 }
@@ -117,17 +140,41 @@ func (server *HttpServer) relayRequest(req *httpRequest) (*Message, os.Error) {
 		panic(err)
 	}
 	
-	server.exchange.Send(string(json), httpTimeout, server.exchangeToAddress, replyAddr)
-	server.exchange.Send(string(req.body), httpTimeout, bodyAddr, "")
+	reqMsg := &Message{ToAddress: server.exchangeToAddress, ReplyAddress: replyAddr, TimeoutMillis: httpTimeout, Body: json}
+	if server.requestHeaders {
+		reqMsg.Headers = make(map[string]string)
+		reqMsg.Headers[methodHeader] = req.method
+		reqMsg.Headers[urlHeader] = req.url
+		reqMsg.Headers[protocolHeader] = req.protocol
+		reqMsg.Headers[bodyAddressHeader] = bodyAddr
+		for key, value := range req.headers {
+			reqMsg.Headers[httpHeaderPrefix + key] = value
+		}
+	}
+	
+	err = server.exchange.SendMessage(reqMsg)
+	if err != nil {
+		return nil, err
+	}
+	
+	err = server.exchange.Send(req.body, httpTimeout, bodyAddr, "")
+	if err != nil {
+		return nil, err
+	}
 	
 	return server.exchange.Ready(httpTimeout, []string{replyAddr}), nil
 }
 
 func (server *HttpServer) relayReply(replyMsg *Message, conn net.Conn) {
+	if _, exists := replyMsg.Headers[statusHeader]; exists {
+		server.relayHeaderReply(replyMsg, conn)
+		return
+	}
+	
 	var err os.Error
 	var reply []interface{}
 		
-	err = json.Unmarshal([]byte(replyMsg.Body), &reply)
+	err = json.Unmarshal(replyMsg.Body, &reply)
 	if err != nil {
 		goto BadReply
 	}
@@ -181,32 +228,70 @@ func (server *HttpServer) relayReply(replyMsg *Message, conn net.Conn) {
 			
 	respBuffer.WriteString("Connection: close\r\n\r\n")
 	
-	_, err = conn.Write(respBuffer.Bytes())
-	if err != nil {
-		// couldn't do the actual writing, just give up
-		conn.Close()
+	server.relayReplyBody(&respBuffer, replyMsg, conn)
+	return
+		
+BadReply:
+	doError(conn, err)
+}
+
+// relayHeaderReply writes a reply whose status and response headers were
+// given as message headers. Its body is the start of the response body.
+func (server *HttpServer) relayHeaderReply(replyMsg *Message, conn net.Conn) {
+	status := replyMsg.Headers[statusHeader]
+	st, ok := statusText[status]
+	if !ok {
+		doError(conn, &badStringError{"not a valid status code", status})
+		return
+	}
+	
+	var respBuffer bytes.Buffer
+	respBuffer.WriteString("HTTP/1.0 " + status + " " + st + "\r\n")
+	
+	for key, value := range replyMsg.Headers {
+		if !strings.HasPrefix(key, httpHeaderPrefix) {
+			continue
+		}
+		
+		kStr := canonicalHeaderKey(key[len(httpHeaderPrefix):])
+		if kStr != "Connection" {
+			respBuffer.WriteString(kStr + ": " + value + "\r\n")
+		}
+	}
+	
+	respBuffer.WriteString("Connection: close\r\n\r\n")
+	respBuffer.Write(replyMsg.Body)
+	
+	server.relayReplyBody(&respBuffer, replyMsg, conn)
+}
+
+// relayReplyBody writes the start of the response in respBuffer, followed
+// by the bodies of the messages sent after replyMsg to its address, up to
+// one that is empty or marked EndOfStream. Nothing follows a replyMsg that
+// is itself marked EndOfStream.
+func (server *HttpServer) relayReplyBody(respBuffer *bytes.Buffer, replyMsg *Message, conn net.Conn) {
+	defer conn.Close()
+	
+	_, err := conn.Write(respBuffer.Bytes())
+	if err != nil || replyMsg.EndOfStream {
+		// either we're done, or couldn't do the actual writing and give up
 		return
 	}
 	
+	replies := server.exchange.replyStream(replyMsg.ToAddress, httpTimeout, nil)
 	for {
-		switch replyBodyMsg := server.exchange.Ready(httpTimeout, []string{replyMsg.ToAddress}); {
+		switch replyBodyMsg, _ := replies.Next(); {
 		case replyBodyMsg == nil:
 			// we really expected a message here... this is busted
-			conn.Close()
 			return
-		case replyBodyMsg.Body == "":
+		case len(replyBodyMsg.Body) == 0:
 			// an empty message indicates we're all done
-			conn.Close()
 			return
 		default:
-			_, err = conn.Write([]byte(replyBodyMsg.Body))
-			if err != nil {
-				conn.Close()
+			_, err = conn.Write(replyBodyMsg.Body)
+			if err != nil || replyBodyMsg.EndOfStream {
 				return
 			}
 		}
 	}
-		
-BadReply:
-	doError(conn, err)
 }
@@ -0,0 +1,329 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"bufio"
+	"container/vector"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	journalEnqueueStr     = "+"
+	journalDeliverStr     = "-"
+	journalExpireStr      = "x"
+	journalSubscribeStr   = "s"
+	journalUnsubscribeStr = "u"
+)
+
+// compact the journal once it holds this many records for messages that
+// are no longer queued
+const journalCompactThreshold = 10000
+
+// The journal is an append-only log of message queue activity. A message
+// is recorded when it is queued and again when it leaves the queue, either
+// by being delivered or by expiring. Messages handed straight to a waiting
+// client never touch the journal.
+//
+// Each enqueue record is a "+ id deadline notBefore" line followed by the
+// message in the same framing the wire protocol uses, so anything a client
+// can send survives a restart. Journals written before messages could be
+// delayed lack the notBefore field and are still read. Delivery and expiry
+// records are "- id" and "x id". Durable subscriptions are recorded as
+// "s toAddr queueAddr" and removed with "u toAddr queueAddr".
+//
+// Records are written straight to the file without an fsync, so queued
+// messages survive the daemon restarting or crashing, but not necessarily
+// the machine going down.
+//
+// Every shard writes to the same journal, so each write takes its lock.
+type journal struct {
+	lock       sync.Mutex
+	path       string
+	file       *os.File
+	stream     *CommandStream
+	live       int
+	dead       int
+	compacting bool
+}
+
+// journalState is what replaying a journal recovers.
+type journalState struct {
+	messages    []Message
+	subscribers map[string]*vector.StringVector
+}
+
+// openJournal replays the journal at path and returns the messages that
+// were still queued, in the order they were originally queued, along with
+// the durable subscriptions. Messages whose deadline has passed are
+// dropped. The journal is then rewritten to contain only what was
+// recovered and left open for appending. A journal that can't be replayed
+// is left untouched and an error returned.
+func openJournal(path string) (*journal, *journalState, os.Error) {
+	live := make(map[uint64]Message)
+	order := new(vector.Vector)
+	state := &journalState{subscribers: make(map[string]*vector.StringVector)}
+
+	file, err := os.Open(path, os.O_RDONLY, 0)
+	if err == nil {
+		err = replayJournal(file, live, order, state.subscribers)
+		file.Close()
+		if err != nil {
+			// leave the journal as it is, so nothing in it is lost
+			return nil, nil, os.NewError(path + ": " + err.String())
+		}
+	} else if pathErr, ok := err.(*os.PathError); !ok || pathErr.Error != os.ENOENT {
+		return nil, nil, err
+	}
+
+	now := time.Nanoseconds()
+	messages := make([]Message, 0, order.Len())
+	for i := 0; i < order.Len(); i++ {
+		// a message given back after its delivery was recorded is
+		// enqueued again under the same id, so its id can be in order
+		// more than once
+		id := order.At(i).(uint64)
+		m, exists := live[id]
+		live[id] = Message{}, false
+		if exists && m.timeout >= now {
+			messages = messages[0 : len(messages)+1]
+			messages[len(messages)-1] = m
+		}
+	}
+
+	state.messages = messages
+
+	j := &journal{path: path}
+	err = j.rewrite(state)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return j, state, nil
+}
+
+// replayJournal reads records until the end of the file. A bad record at
+// the end of the file, left behind by a crash in the middle of a write, is
+// ignored, but one followed by more records is an error, since skipping
+// it would lose everything after it.
+func replayJournal(file *os.File, live map[uint64]Message, order *vector.Vector, subscribers map[string]*vector.StringVector) os.Error {
+	stream := &CommandStream{bufio.NewReader(file), nil, false}
+
+	for record := 1; ; record++ {
+		command, err := stream.ReadCommand()
+		if err == os.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = replayRecord(stream, command, live, order, subscribers)
+		if err != nil {
+			if _, err := stream.reader.ReadByte(); err == os.EOF {
+				return nil
+			}
+			return os.NewError("journal record " + strconv.Itoa(record) + ": " + err.String())
+		}
+	}
+
+	panic("unreachable")
+}
+
+// replayRecord applies the record that starts with command.
+func replayRecord(stream *CommandStream, command []string, live map[uint64]Message, order *vector.Vector, subscribers map[string]*vector.StringVector) os.Error {
+	if len(command) == 0 {
+		return os.NewError("empty record")
+	}
+
+	switch command[0] {
+	case journalEnqueueStr:
+		// journals written before messages could be delayed have no
+		// notBefore field
+		if len(command) != 3 && len(command) != 4 {
+			return os.NewError("invalid enqueue record")
+		}
+
+		id, err := strconv.Atoui64(command[1])
+		if err != nil {
+			return os.NewError("invalid message id")
+		}
+
+		deadline, err := strconv.Atoi64(command[2])
+		if err != nil {
+			return os.NewError("invalid deadline")
+		}
+
+		var notBefore int64
+		if len(command) == 4 {
+			notBefore, err = strconv.Atoi64(command[3])
+			if err != nil {
+				return os.NewError("invalid notBefore")
+			}
+		}
+
+		m, err := stream.ReadMessage()
+		if err != nil {
+			return err
+		} else if m == nil {
+			return os.NewError("missing message")
+		}
+
+		m.id = id
+		m.timeout = deadline
+		m.notBefore = notBefore
+		live[id] = *m
+		order.Push(id)
+
+	case journalDeliverStr, journalExpireStr:
+		if len(command) != 2 {
+			return os.NewError("invalid delivery record")
+		}
+
+		id, err := strconv.Atoui64(command[1])
+		if err != nil {
+			return os.NewError("invalid message id")
+		}
+
+		live[id] = Message{}, false
+
+	case journalSubscribeStr, journalUnsubscribeStr:
+		if len(command) != 3 {
+			return os.NewError("invalid subscription record")
+		}
+
+		updateSubscribers(subscribers, command[1], command[2], command[0] == journalSubscribeStr)
+
+	default:
+		return os.NewError("unknown record type: " + command[0])
+	}
+
+	return nil
+}
+
+// rewrite replaces the journal file with one containing an enqueue record
+// for each queued message and a subscribe record for each subscription,
+// and reopens it for appending.
+func (j *journal) rewrite(state *journalState) os.Error {
+	tmpPath := j.path + ".tmp"
+
+	file, err := os.Open(tmpPath, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	stream := &CommandStream{nil, file, false}
+	for i := 0; i < len(state.messages); i++ {
+		err = writeJournalEnqueue(stream, &state.messages[i])
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	for toAddress, queueAddresses := range state.subscribers {
+		for i := 0; i < queueAddresses.Len(); i++ {
+			err = stream.WriteCommand([]string{journalSubscribeStr, toAddress, queueAddresses.At(i)})
+			if err != nil {
+				file.Close()
+				return err
+			}
+		}
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, j.path)
+	if err != nil {
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+
+	j.file, err = os.Open(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	j.stream = &CommandStream{nil, j.file, false}
+	j.live = len(state.messages)
+	j.dead = 0
+	return nil
+}
+
+func writeJournalEnqueue(stream *CommandStream, m *Message) os.Error {
+	err := stream.WriteCommand([]string{journalEnqueueStr, strconv.Uitoa64(m.id), strconv.Itoa64(m.timeout), strconv.Itoa64(m.notBefore)})
+	if err != nil {
+		return err
+	}
+	return stream.WriteMessage(m)
+}
+
+func (j *journal) enqueued(m *Message) os.Error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	
+	j.live++
+	return writeJournalEnqueue(j.stream, m)
+}
+
+func (j *journal) delivered(id uint64) os.Error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	
+	j.live--
+	j.dead++
+	return j.stream.WriteCommand([]string{journalDeliverStr, strconv.Uitoa64(id)})
+}
+
+func (j *journal) expired(id uint64) os.Error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	
+	j.live--
+	j.dead++
+	return j.stream.WriteCommand([]string{journalExpireStr, strconv.Uitoa64(id)})
+}
+
+// startCompaction reports whether the journal needs compacting and nobody
+// has started doing it yet. Whoever it returns true for must call compact.
+func (j *journal) startCompaction() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	
+	if j.compacting || j.dead < journalCompactThreshold || j.dead <= j.live {
+		return false
+	}
+	j.compacting = true
+	return true
+}
+
+// compact rewrites the journal with state, which must be everything that
+// is live across all shards.
+func (j *journal) compact(state *journalState) os.Error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	
+	j.compacting = false
+	return j.rewrite(state)
+}
+
+func (j *journal) subscribed(toAddress string, queueAddress string, subscribe bool) os.Error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	
+	op := journalUnsubscribeStr
+	if subscribe {
+		op = journalSubscribeStr
+	}
+	return j.stream.WriteCommand([]string{op, toAddress, queueAddress})
+}
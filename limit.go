@@ -0,0 +1,291 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"container/vector"
+	"os"
+	"time"
+)
+
+// what happens to a message sent to a queue that is full
+const (
+	OverflowReject = iota
+	OverflowDropOldest
+	OverflowBlock
+)
+
+const overflowNone = -1
+
+// A QueueLimit caps the number of messages and the total size of their
+// bodies that may wait in a queue. A zero MaxDepth or MaxBytes means no
+// limit. Policy is one of OverflowReject, which fails the send,
+// OverflowDropOldest, which makes room by moving the oldest queued message
+// to its dead-letter address, or OverflowBlock, which holds the sender
+// until there is room or its message times out.
+//
+// Limits only apply to messages as they are sent. Messages coming back
+// from a delay, a missed ack or a dead letter are always queued.
+type QueueLimit struct {
+	MaxDepth int
+	MaxBytes int
+	Policy   int
+}
+
+func (limit *QueueLimit) exceededBy(depth int, bytes int, m *Message) bool {
+	return limit.MaxDepth > 0 && depth + 1 > limit.MaxDepth ||
+		limit.MaxBytes > 0 && bytes + len(m.Body) > limit.MaxBytes
+}
+
+// SetQueueLimit limits the queue on address.
+func (exchange *Exchange) SetQueueLimit(address string, limit QueueLimit) {
+	exchange.shardFor(address).queueLimits[address] = &limit
+}
+
+// SetDefaultQueueLimit limits the queue on every address that doesn't have
+// a limit of its own.
+func (exchange *Exchange) SetDefaultQueueLimit(limit QueueLimit) {
+	for _, shard := range exchange.shards {
+		shard.defaultQueueLimit = &limit
+	}
+}
+
+// SetExchangeLimit limits the number and total size of messages queued on
+// all addresses put together. When its policy is OverflowDropOldest, the
+// oldest message on the address being sent to is dropped.
+func (exchange *Exchange) SetExchangeLimit(limit QueueLimit) {
+	for _, shard := range exchange.shards {
+		shard.exchangeLimit = &limit
+	}
+}
+
+type sendRequest struct {
+	m         Message
+	replyChan chan os.Error
+	deadline  *deadline
+}
+
+func (shard *exchangeShard) handleSendRequest(req *sendRequest) {
+	if req.m.Mandatory && shard.handleMandatory(req) {
+		return
+	}
+	
+	switch shard.overflowPolicy(&req.m) {
+	case overflowNone:
+		shard.handleMessage(req.m)
+		req.replyChan <- nil
+
+	case OverflowDropOldest:
+		for shard.overflowPolicy(&req.m) != overflowNone {
+			if !shard.dropOldest(req.m.ToAddress) {
+				shard.rejectSend(req)
+				return
+			}
+		}
+		shard.handleMessage(req.m)
+		req.replyChan <- nil
+
+	case OverflowBlock:
+		shard.logf(LogLevelInfo, "> %v %v %v %v", len(req.m.Body), FormatMillis(req.m.TimeoutMillis), req.m.ToAddress, req.m.ReplyAddress)
+		shard.logf(LogLevelInfo, "  blocked, queue full")
+
+		blocked := shard.blockedSenders[req.m.ToAddress]
+		if blocked == nil {
+			blocked = new(vector.Vector)
+			shard.blockedSenders[req.m.ToAddress] = blocked
+		}
+		blocked.Push(req)
+		shard.blockedCount++
+		shard.totals.addBlocked(1)
+		
+		req.deadline = shard.addDeadline(req.m.timeout, func() {
+			shard.expireBlockedSender(req)
+		})
+
+	default:
+		shard.rejectSend(req)
+	}
+}
+
+func (shard *exchangeShard) rejectSend(req *sendRequest) {
+	shard.logf(LogLevelInfo, "> %v %v %v %v", len(req.m.Body), FormatMillis(req.m.TimeoutMillis), req.m.ToAddress, req.m.ReplyAddress)
+	shard.logf(LogLevelInfo, "  rejected, queue full")
+	shard.notifyExpiry(req.m, ReasonOverflow)
+	req.replyChan <- &queueFullError{req.m.ToAddress, false}
+}
+
+// A queueFullError is returned for a message turned away because its queue
+// was full, either straight away or after waiting for room.
+type queueFullError struct {
+	address  string
+	timedOut bool
+}
+
+func (err *queueFullError) String() string {
+	if err.timedOut {
+		return "send timed out waiting for room in queue: " + err.address
+	}
+	return "queue full: " + err.address
+}
+
+// wouldQueue reports whether m would end up in a message queue if it were
+// handled right now, rather than being delayed or handed straight to a
+// waiting client.
+func (shard *exchangeShard) wouldQueue(m *Message) bool {
+	return shard.isImmediate(m) && shard.waitingReadyState(m.ToAddress) == nil
+}
+
+// waitingReadyState returns the ready state that has been waiting longest
+// on address and hasn't been answered by another shard, dropping any that
+// have, or nil if there is none.
+func (shard *exchangeShard) waitingReadyState(address string) *readyState {
+	for rs := shard.oldestReadyState(address); rs != nil; rs = shard.oldestReadyState(address) {
+		if !rs.waiter.isClaimed() {
+			return rs
+		}
+		shard.unqueueReadyState(rs)
+	}
+	return nil
+}
+
+// isImmediate reports whether m would be handed to a waiting client or
+// queued as soon as it is handled, rather than being delayed or broadcast.
+func (shard *exchangeShard) isImmediate(m *Message) bool {
+	return m.notBefore <= time.Nanoseconds() && !m.Fanout && !shard.fanoutAddresses[m.ToAddress]
+}
+
+// overflowPolicy returns the policy to apply if queueing m would exceed
+// the limit on its address or on the exchange, or overflowNone if it fits.
+// When it fits, room for m is reserved on the exchange, to be taken up
+// when m is queued or given back once the shard finishes what it is doing.
+func (shard *exchangeShard) overflowPolicy(m *Message) int {
+	return shard.overflowPolicyAfter(m, nil)
+}
+
+// overflowPolicyAfter is like overflowPolicy, but as if the messages
+// counted by pending, which may be nil, were already queued on this
+// shard's addresses. They have already reserved their room on the exchange.
+//
+// With pending, m is part of a transaction, and is checked as though
+// nobody were waiting for it: a waiting client may be answered by another
+// shard before the transaction commits, leaving m to be queued after all.
+func (shard *exchangeShard) overflowPolicyAfter(m *Message, pending *pendingCounts) int {
+	queues := shard.isImmediate(m)
+	if pending == nil {
+		queues = shard.wouldQueue(m)
+	}
+	if !queues {
+		return overflowNone
+	}
+
+	limit, exists := shard.queueLimits[m.ToAddress]
+	if !exists {
+		limit = shard.defaultQueueLimit
+	}
+
+	if limit != nil {
+		depth := pending.depth(m.ToAddress)
+		if messageQueue, exists := shard.messageQueues[m.ToAddress]; exists {
+			depth += messageQueue.Len()
+		}
+		if limit.exceededBy(depth, shard.queueBytes[m.ToAddress] + pending.addressBytes(m.ToAddress), m) {
+			return limit.Policy
+		}
+	}
+
+	if shard.exchangeLimit != nil {
+		// room is reserved last, once nothing else can stop m queueing
+		if !shard.totals.reserve(shard.exchangeLimit, m) {
+			return shard.exchangeLimit.Policy
+		}
+		shard.reservedCount++
+		shard.reservedBytes += len(m.Body)
+	}
+
+	return overflowNone
+}
+
+// releaseReserved gives back the room reserved for messages that weren't
+// queued after all, because they went straight to a waiting client or
+// their transaction was abandoned.
+func (shard *exchangeShard) releaseReserved() {
+	if shard.totals.add(-shard.reservedCount, -shard.reservedBytes) {
+		shard.exchange.wakeShards()
+	}
+	shard.reservedCount = 0
+	shard.reservedBytes = 0
+}
+
+// dropOldest removes the message that was sent longest ago from the queue
+// on address, and reports whether there was one to remove.
+func (shard *exchangeShard) dropOldest(address string) bool {
+	messageQueue, exists := shard.messageQueues[address]
+	if !exists {
+		return false
+	}
+
+	oldest := 0
+	for i := 1; i < messageQueue.Len(); i++ {
+		if messageQueue.At(i).(Message).id < messageQueue.At(oldest).(Message).id {
+			oldest = i
+		}
+	}
+
+	m := shard.removeQueued(address, oldest)
+
+	shard.logf(LogLevelInfo, "> %v %v %v %v", len(m.Body), FormatMillis(m.TimeoutMillis), m.ToAddress, m.ReplyAddress)
+	shard.logf(LogLevelInfo, "  dropped, queue full")
+	if shard.journal != nil {
+		shard.journalError(shard.journal.expired(m.id))
+	}
+	shard.deadLetter(m, ReasonOverflow)
+	return true
+}
+
+// admitBlockedSenders queues the messages of blocked senders for which
+// there is now room, oldest first on each address.
+func (shard *exchangeShard) admitBlockedSenders() {
+	for address, blocked := range shard.blockedSenders {
+		for blocked.Len() > 0 {
+			req := blocked.At(0).(*sendRequest)
+			if shard.overflowPolicy(&req.m) != overflowNone {
+				break
+			}
+
+			blocked.Delete(0)
+			shard.blockedCount--
+			shard.totals.addBlocked(-1)
+			shard.removeDeadline(req.deadline)
+			shard.handleMessage(req.m)
+			req.replyChan <- nil
+		}
+
+		if blocked.Len() == 0 {
+			shard.blockedSenders[address] = nil, false
+		}
+	}
+}
+
+// expireBlockedSender fails the send of a blocked sender whose message has
+// timed out while waiting for room.
+func (shard *exchangeShard) expireBlockedSender(req *sendRequest) {
+	address := req.m.ToAddress
+	blocked := shard.blockedSenders[address]
+	
+	for i := 0; i < blocked.Len(); i++ {
+		if blocked.At(i).(*sendRequest) == req {
+			blocked.Delete(i)
+			shard.blockedCount--
+			shard.totals.addBlocked(-1)
+			shard.notifyExpiry(req.m, ReasonOverflow)
+			req.replyChan <- &queueFullError{address, true}
+			break
+		}
+	}
+	
+	if blocked.Len() == 0 {
+		shard.blockedSenders[address] = nil, false
+	}
+}
\ No newline at end of file
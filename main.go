@@ -10,20 +10,45 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
 )
 
 const versionString = "v0.1.6"
 
 func main() {
-	var network, laddr, httpNetwork, httpLaddr, httpReqMsgAddr, logLevel string
+	var network, laddr, httpNetwork, httpLaddr, httpReqMsgAddr, logLevel, journalPath, fanoutAddrs, deadLetterAddr, deadLetterAddrs string
+	var deadLetterTimeout int64
+	var queueLimit, totalLimit, queueLimits string
+	var procs int
+	var adminNetwork, adminLaddr string
+	var ownedAddrs, httpHeaders bool
+	var routesPath string
 	flag.StringVar(&network, "network", "unix", "unix or tcp")
 	flag.StringVar(&laddr, "address", "", "listen address (either socket path, or ip:port)")
 	flag.StringVar(&httpNetwork, "http-network", "tcp", "unix or tcp")
 	flag.StringVar(&httpLaddr, "http-address", "", "http listen address (either socket path, or ip:port)")
 	flag.StringVar(&httpReqMsgAddr, "http-msg-address", "msglite.httpRequests", "msglite address to which http request messages are sent")
+	flag.BoolVar(&httpHeaders, "http-headers", false, "also send the request line and http headers of each request as message headers, which older workers can't read")
 	flag.StringVar(&logLevel, "loglevel", "info", "logging level (one of 'minimal', 'info' or 'debug')")
+	flag.StringVar(&fanoutAddrs, "fanout-addresses", "", "comma separated list of addresses whose messages are broadcast to every listener")
+	flag.StringVar(&deadLetterAddr, "dead-letter-address", "", "address to which expired and rejected messages are moved")
+	flag.StringVar(&deadLetterAddrs, "dead-letter-addresses", "", "comma separated list of addr=deadLetterAddr pairs overriding -dead-letter-address")
+	flag.Int64Var(&deadLetterTimeout, "dead-letter-timeout", 86400, "seconds that messages are kept on dead-letter addresses")
+	flag.StringVar(&queueLimit, "queue-limit", "", "default limit on each address's queue, as maxDepth:maxBytes:policy where policy is one of 'reject', 'drop-oldest' or 'block'")
+	flag.StringVar(&queueLimits, "queue-limits", "", "comma separated list of addr=maxDepth:maxBytes:policy limits overriding -queue-limit")
+	flag.StringVar(&totalLimit, "total-limit", "", "limit on all queues together, as maxDepth:maxBytes:policy")
+	flag.StringVar(&adminNetwork, "admin-network", "unix", "unix or tcp")
+	flag.StringVar(&adminLaddr, "admin-address", "", "admin listen address (either socket path, or ip:port), whose clients may list, peek at and purge queues")
+	flag.BoolVar(&ownedAddrs, "owned-addresses", false, "only let the connection that sent a query Ready on its reply address")
+	flag.StringVar(&routesPath, "routes", "", "path of a file listing routes, one per line as addr target1[:weight1] [target2[:weight2]..]")
+	flag.StringVar(&journalPath, "journal", "", "path of the journal file in which queued messages are kept across restarts")
+	flag.IntVar(&procs, "procs", 1, "number of threads to run at once, and of shards the exchange is split into")
 	flag.Parse()
 	
+	runtime.GOMAXPROCS(procs)
+	
 	if laddr == "" {
 		switch network {
 		case "unix":
@@ -33,7 +58,17 @@ func main() {
 		}
 	}	
 	
-	exchange := msglite.NewExchange()
+	var exchange *msglite.Exchange
+	if journalPath != "" {
+		var err os.Error
+		exchange, err = msglite.NewJournaledExchange(journalPath)
+		if err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("unable to open journal %v: %v\n", journalPath, err))
+			os.Exit(1)
+		}
+	} else {
+		exchange = msglite.NewExchange()
+	}
 	
 	switch logLevel {
 	case "minimal":
@@ -48,12 +83,66 @@ func main() {
 		os.Exit(1)
 	}
 	
+	if fanoutAddrs != "" {
+		for _, addr := range strings.Split(fanoutAddrs, ",", -1) {
+			exchange.SetFanout(addr, true)
+		}
+	}
+	
+	exchange.SetDeadLetterAddress(deadLetterAddr, deadLetterTimeout * 1000)
+	if deadLetterAddrs != "" {
+		for _, pair := range strings.Split(deadLetterAddrs, ",", -1) {
+			addrs := strings.Split(pair, "=", 2)
+			if len(addrs) != 2 {
+				os.Stderr.WriteString(fmt.Sprintf("invalid dead letter address: %v\n", pair))
+				flag.PrintDefaults()
+				os.Exit(1)
+			}
+			exchange.SetAddressDeadLetterAddress(addrs[0], addrs[1])
+		}
+	}
+	
+	if queueLimit != "" {
+		exchange.SetDefaultQueueLimit(parseQueueLimit(queueLimit))
+	}
+	if totalLimit != "" {
+		exchange.SetExchangeLimit(parseQueueLimit(totalLimit))
+	}
+	if queueLimits != "" {
+		for _, pair := range strings.Split(queueLimits, ",", -1) {
+			addrLimit := strings.Split(pair, "=", 2)
+			if len(addrLimit) != 2 {
+				badQueueLimit(pair)
+			}
+			exchange.SetQueueLimit(addrLimit[0], parseQueueLimit(addrLimit[1]))
+		}
+	}
+	
+	if routesPath != "" {
+		err := exchange.LoadRoutes(routesPath)
+		if err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("unable to load routes: %v\n", err))
+			os.Exit(1)
+		}
+	}
+	
+	exchange.Start()
+	
 	server := msglite.NewServer(exchange, network, laddr)
+	server.SetOwnedAddresses(ownedAddrs)
 	fmt.Printf("msglite %v listening on %v (%v)\n", versionString, laddr, network)
 	
+	var adminServer *msglite.Server
+	if adminLaddr != "" {
+		adminServer = msglite.NewAdminServer(exchange, adminNetwork, adminLaddr)
+		go adminServer.Run()
+		fmt.Printf("msglite admin server listening on %v (%v)\n", adminLaddr, adminNetwork)
+	}
+	
 	var httpServer *msglite.HttpServer
 	if httpLaddr != "" {
 		httpServer = msglite.NewHttpServer(exchange, httpNetwork, httpLaddr, httpReqMsgAddr)
+		httpServer.SetRequestHeaders(httpHeaders)
 		go httpServer.Run()
 		fmt.Printf("msglite http server listening on %v (%v) requests are bing routed to %v\n", httpLaddr, httpNetwork, httpReqMsgAddr)
 	}
@@ -77,9 +166,49 @@ func main() {
 		if httpServer != nil {
 			httpServer.Quit()
 		}
+		if adminServer != nil {
+			adminServer.Quit()
+		}
 		server.Quit()
 	}()
 	
 	server.Run()
 	fmt.Printf("msglite quitting\n")
 }
+
+func parseQueueLimit(s string) (limit msglite.QueueLimit) {
+	fields := strings.Split(s, ":", -1)
+	if len(fields) != 3 {
+		badQueueLimit(s)
+	}
+	
+	var err os.Error
+	limit.MaxDepth, err = strconv.Atoi(fields[0])
+	if err != nil {
+		badQueueLimit(s)
+	}
+	
+	limit.MaxBytes, err = strconv.Atoi(fields[1])
+	if err != nil {
+		badQueueLimit(s)
+	}
+	
+	switch fields[2] {
+	case "reject":
+		limit.Policy = msglite.OverflowReject
+	case "drop-oldest":
+		limit.Policy = msglite.OverflowDropOldest
+	case "block":
+		limit.Policy = msglite.OverflowBlock
+	default:
+		badQueueLimit(s)
+	}
+	
+	return
+}
+
+func badQueueLimit(s string) {
+	os.Stderr.WriteString(fmt.Sprintf("invalid queue limit: %v\n", s))
+	flag.PrintDefaults()
+	os.Exit(1)
+}
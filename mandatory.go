@@ -0,0 +1,107 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"container/vector"
+	"os"
+	"time"
+)
+
+// ErrNoListener is returned for a mandatory message when nobody is
+// waiting to receive it.
+var ErrNoListener = os.NewError("no listener")
+
+// hasListener reports whether a client is waiting on m's address, or, if m
+// is to be broadcast, whether its address has subscribers. Ready states
+// whose waiters were answered by another shard are dropped along the way.
+func (shard *exchangeShard) hasListener(m *Message) bool {
+	if m.Fanout || shard.fanoutAddresses[m.ToAddress] {
+		if subscribers, exists := shard.subscribers[m.ToAddress]; exists && subscribers.Len() > 0 {
+			return true
+		}
+	}
+
+	return shard.waitingReadyState(m.ToAddress) != nil
+}
+
+// handleMandatory holds or refuses the send of a mandatory message that
+// nobody is waiting for, and reports whether it did. Otherwise the message
+// is sent as usual, and is no longer marked mandatory when it arrives.
+func (shard *exchangeShard) handleMandatory(req *sendRequest) bool {
+	if shard.hasListener(&req.m) {
+		req.m.Mandatory = false
+		req.m.MandatoryWaitMillis = 0
+		return false
+	}
+
+	shard.logf(LogLevelInfo, "> %v %v %v %v", len(req.m.Body), FormatMillis(req.m.TimeoutMillis), req.m.ToAddress, req.m.ReplyAddress)
+
+	if req.m.MandatoryWaitMillis <= 0 {
+		shard.logf(LogLevelInfo, "  refused, no listener")
+		req.replyChan <- ErrNoListener
+		return true
+	}
+
+	shard.logf(LogLevelInfo, "  waiting for a listener")
+
+	awaiting := shard.awaitingSenders[req.m.ToAddress]
+	if awaiting == nil {
+		awaiting = new(vector.Vector)
+		shard.awaitingSenders[req.m.ToAddress] = awaiting
+	}
+	awaiting.Push(req)
+	shard.awaitingCount++
+
+	req.deadline = shard.addDeadline(time.Nanoseconds() + (req.m.MandatoryWaitMillis * 1e6), func() {
+		shard.expireAwaitingSender(req)
+	})
+	return true
+}
+
+// admitAwaitingSenders sends the messages of senders waiting for a
+// listener that now has one, oldest first on each address.
+func (shard *exchangeShard) admitAwaitingSenders() {
+	for address, awaiting := range shard.awaitingSenders {
+		for awaiting.Len() > 0 {
+			req := awaiting.At(0).(*sendRequest)
+			if !shard.hasListener(&req.m) {
+				break
+			}
+
+			awaiting.Delete(0)
+			shard.awaitingCount--
+			shard.removeDeadline(req.deadline)
+			req.deadline = nil
+			shard.handleSendRequest(req)
+		}
+
+		if awaiting.Len() == 0 {
+			shard.awaitingSenders[address] = nil, false
+		}
+	}
+}
+
+// expireAwaitingSender fails the send of a sender that has waited as long
+// as it was willing to for a listener.
+func (shard *exchangeShard) expireAwaitingSender(req *sendRequest) {
+	address := req.m.ToAddress
+	awaiting := shard.awaitingSenders[address]
+
+	for i := 0; i < awaiting.Len(); i++ {
+		if awaiting.At(i).(*sendRequest) == req {
+			awaiting.Delete(i)
+			shard.awaitingCount--
+			shard.logf(LogLevelInfo, "> %v %v %v %v", len(req.m.Body), FormatMillis(req.m.TimeoutMillis), address, req.m.ReplyAddress)
+			shard.logf(LogLevelInfo, "  refused, no listener")
+			req.replyChan <- ErrNoListener
+			break
+		}
+	}
+
+	if awaiting.Len() == 0 {
+		shard.awaitingSenders[address] = nil, false
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+// An AddressOwner generates addresses that nobody else may Ready on, such
+// as the reply addresses of a connection's queries. The server gives each
+// connection an owner when it is asked to, and releases it when the
+// connection closes.
+type AddressOwner struct {
+	exchange  *Exchange
+	addresses map[string]bool
+}
+
+func (exchange *Exchange) NewAddressOwner() *AddressOwner {
+	return &AddressOwner{exchange, make(map[string]bool)}
+}
+
+// GenerateAddress returns a new address like GenerateUnusedAddress does,
+// owned by owner.
+func (owner *AddressOwner) GenerateAddress() string {
+	address := owner.exchange.GenerateUnusedAddress()
+
+	owner.exchange.addressLock.Lock()
+	defer owner.exchange.addressLock.Unlock()
+
+	owner.exchange.owners[address] = owner
+	owner.addresses[address] = true
+	return address
+}
+
+// ReleaseAddress gives up owning address, once it is no longer needed.
+func (owner *AddressOwner) ReleaseAddress(address string) {
+	owner.exchange.addressLock.Lock()
+	defer owner.exchange.addressLock.Unlock()
+
+	if owner.exchange.owners[address] == owner {
+		owner.exchange.owners[address] = nil, false
+	}
+	owner.addresses[address] = false, false
+}
+
+// Release gives up owning every address owner still owns.
+func (owner *AddressOwner) Release() {
+	owner.exchange.addressLock.Lock()
+	defer owner.exchange.addressLock.Unlock()
+
+	for address := range owner.addresses {
+		if owner.exchange.owners[address] == owner {
+			owner.exchange.owners[address] = nil, false
+		}
+	}
+	owner.addresses = make(map[string]bool)
+}
+
+// mayReady reports whether a client acting for owner, which may be nil,
+// may Ready on every one of onAddresses. Patterns never match generated
+// addresses, so only the addresses themselves need checking.
+func (exchange *Exchange) mayReady(owner *AddressOwner, onAddresses []string) bool {
+	exchange.addressLock.Lock()
+	defer exchange.addressLock.Unlock()
+
+	for _, onAddress := range onAddresses {
+		if addressOwner, exists := exchange.owners[onAddress]; exists && addressOwner != owner {
+			return false
+		}
+	}
+	return true
+}
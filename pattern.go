@@ -0,0 +1,63 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"strings"
+)
+
+// Addresses are made up of segments separated by dots. A client waiting
+// in Ready may use a pattern in place of an address, where a "*" segment
+// matches exactly one segment and a "#" segment matches zero or more, so
+// "orders.*" matches "orders.new" and "orders.#" matches "orders",
+// "orders.new" and "orders.new.priority".
+const (
+	addressSeparator = "."
+	matchOneSegment  = "*"
+	matchAnySegments = "#"
+)
+
+// isPattern reports whether address contains any wildcard segments.
+func isPattern(address string) bool {
+	for _, segment := range strings.Split(address, addressSeparator, -1) {
+		if segment == matchOneSegment || segment == matchAnySegments {
+			return true
+		}
+	}
+	return false
+}
+
+// generatedAddressPrefix starts every generated address. Generated
+// addresses are private to whoever generated them, so no pattern matches
+// them.
+const generatedAddressPrefix = "~"
+
+// matchAddress reports whether address is matched by pattern.
+func matchAddress(pattern string, address string) bool {
+	if strings.HasPrefix(address, generatedAddressPrefix) {
+		return false
+	}
+	return matchSegments(strings.Split(pattern, addressSeparator, -1), strings.Split(address, addressSeparator, -1))
+}
+
+func matchSegments(pattern []string, address []string) bool {
+	if len(pattern) == 0 {
+		return len(address) == 0
+	}
+
+	switch pattern[0] {
+	case matchAnySegments:
+		for i := 0; i <= len(address); i++ {
+			if matchSegments(pattern[1:], address[i:]) {
+				return true
+			}
+		}
+		return false
+	case matchOneSegment:
+		return len(address) > 0 && matchSegments(pattern[1:], address[1:])
+	}
+
+	return len(address) > 0 && pattern[0] == address[0] && matchSegments(pattern[1:], address[1:])
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"os"
+)
+
+// ErrStreamTimeout is returned by ReplyStream.Next when a reply doesn't
+// arrive in time.
+var ErrStreamTimeout = os.NewError("reply stream timed out")
+
+// A ReplyStream receives the replies to a streamed query in the order they
+// were sent. The replier sends any number of replies to the query's reply
+// address, marking the last one with EndOfStream.
+type ReplyStream struct {
+	// receive returns the next reply, or nil if it didn't arrive in time
+	receive func() (*Message, os.Error)
+	ended   bool
+}
+
+// Next returns the next reply, or nil once the reply marked EndOfStream
+// has been returned. Each reply is waited for up to the query's timeout,
+// and if one doesn't arrive in time, Next returns ErrStreamTimeout and the
+// stream ends. An expiry notice, which has its Reason set, also ends the
+// stream, and is marked EndOfStream when it is returned.
+func (replies *ReplyStream) Next() (*Message, os.Error) {
+	if replies.ended {
+		return nil, nil
+	}
+
+	msg, err := replies.receive()
+	switch {
+	case err != nil:
+		replies.ended = true
+		return nil, err
+	case msg == nil:
+		replies.ended = true
+		return nil, ErrStreamTimeout
+	case msg.EndOfStream || msg.Reason != "":
+		msg.EndOfStream = true
+		replies.ended = true
+	}
+	return msg, nil
+}
+
+// QueryStream sends a copy of msg with a newly generated reply address and
+// returns the stream of replies to it. It returns nil if the query is
+// turned away because its queue is full.
+func (exchange *Exchange) QueryStream(msg *Message) *ReplyStream {
+	return exchange.QueryStreamCancel(msg, nil)
+}
+
+// QueryStreamCancel is like QueryStream, but the stream stops waiting and
+// ends with ErrStreamTimeout as soon as cancelChan is closed.
+func (exchange *Exchange) QueryStreamCancel(msg *Message, cancelChan <-chan bool) *ReplyStream {
+	return exchange.queryStream(msg, exchange.GenerateUnusedAddress(), cancelChan)
+}
+
+func (exchange *Exchange) queryStream(msg *Message, replyAddress string, cancelChan <-chan bool) *ReplyStream {
+	m := *msg
+	m.ReplyAddress = replyAddress
+	if !awaitsReply(&m, exchange.SendMessage(&m)) {
+		return nil
+	}
+	return exchange.replyStream(replyAddress, replyTimeout(&m), cancelChan)
+}
+
+// replyStream returns the stream of replies sent to replyAddress, each of
+// which is waited for up to timeoutMillis.
+func (exchange *Exchange) replyStream(replyAddress string, timeoutMillis int64, cancelChan <-chan bool) *ReplyStream {
+	return &ReplyStream{receive: func() (*Message, os.Error) {
+		return exchange.ReadyCancel(timeoutMillis, []string{replyAddress}, 0, cancelChan), nil
+	}}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A Route sends messages addressed to one address to its Targets instead.
+// A route with a single target makes the address an alias. With several,
+// messages are split between them in proportion to Weights, which may be
+// nil to split them evenly, so a new version of a worker can be given a
+// small share of an address's messages before taking it over.
+//
+// Routes apply to messages as they are sent, including the subscriber
+// copies, dead letters and expiry notices the exchange sends itself, so
+// they can be changed while the exchange is running, and workers waiting
+// on the targets don't need to know about them. A message that is
+// requeued goes back to the queue it was routed to. A target may itself
+// be routed, up to maxRouteHops routes deep.
+type Route struct {
+	Targets []string
+	Weights []int
+}
+
+// maxRouteHops is the most routes a message follows, so routes that lead
+// back to themselves can't send a message round forever.
+const maxRouteHops = 8
+
+type routeState struct {
+	route  Route
+	credit []int
+}
+
+// SetRoute routes messages sent to address as described by route,
+// replacing any route address already has.
+func (exchange *Exchange) SetRoute(address string, route Route) os.Error {
+	if len(route.Targets) == 0 {
+		return os.NewError("a route needs at least one target")
+	}
+
+	err := checkRouteAddress(address)
+	if err != nil {
+		return err
+	}
+	for _, target := range route.Targets {
+		err = checkRouteAddress(target)
+		if err != nil {
+			return err
+		}
+	}
+
+	if route.Weights == nil {
+		route.Weights = make([]int, len(route.Targets))
+		for i := range route.Weights {
+			route.Weights[i] = 1
+		}
+	}
+	if len(route.Weights) != len(route.Targets) {
+		return os.NewError("a route needs a weight for each target")
+	}
+	for _, weight := range route.Weights {
+		if weight < 1 {
+			return os.NewError("route weights must be positive")
+		}
+	}
+
+	exchange.routeLock.Lock()
+	defer exchange.routeLock.Unlock()
+
+	exchange.routes[address] = &routeState{route, make([]int, len(route.Targets))}
+	return nil
+}
+
+// checkRouteAddress returns an error unless address can be routed, or be
+// the target of a route. That rules out patterns, which only a Ready may
+// use, and generated addresses, which are private to whoever generated
+// them.
+func checkRouteAddress(address string) os.Error {
+	fields := strings.Fields(address)
+	switch {
+	case len(fields) != 1 || fields[0] != address:
+		return os.NewError("invalid route address: \"" + address + "\"")
+	case isPattern(address):
+		return os.NewError("a route can't use a pattern: " + address)
+	case strings.HasPrefix(address, generatedAddressPrefix):
+		return os.NewError("a route can't use a generated address: " + address)
+	}
+	return nil
+}
+
+// RemoveRoute stops routing messages sent to address.
+func (exchange *Exchange) RemoveRoute(address string) {
+	exchange.routeLock.Lock()
+	defer exchange.routeLock.Unlock()
+
+	exchange.routes[address] = nil, false
+}
+
+// Routes returns a copy of the routing table.
+func (exchange *Exchange) Routes() map[string]Route {
+	exchange.routeLock.Lock()
+	defer exchange.routeLock.Unlock()
+
+	routes := make(map[string]Route)
+	for address, state := range exchange.routes {
+		routes[address] = state.route
+	}
+	return routes
+}
+
+// resolve returns the address a message sent to address should go to.
+func (exchange *Exchange) resolve(address string) string {
+	exchange.routeLock.Lock()
+	defer exchange.routeLock.Unlock()
+
+	for hops := 0; hops < maxRouteHops; hops++ {
+		state, exists := exchange.routes[address]
+		if !exists {
+			break
+		}
+		address = state.route.Targets[pickWeighted(state.credit, state.route.Weights, nil)]
+	}
+	return address
+}
+
+// LoadRoutes sets the routes listed in the file at path. Each line holds
+// an address followed by its targets, each of which may be followed by a
+// colon and its weight, as in "checkout checkout.v1:9 checkout.v2:1".
+// Blank lines and lines starting with "#" are ignored.
+func (exchange *Exchange) LoadRoutes(path string) os.Error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for i, line := range strings.Split(string(contents), "\n", -1) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		route, err := ParseRoute(fields[1:])
+		if err == nil {
+			err = exchange.SetRoute(fields[0], route)
+		}
+		if err != nil {
+			return os.NewError(path + ":" + strconv.Itoa(i + 1) + ": " + err.String())
+		}
+	}
+	return nil
+}
+
+// ParseRoute parses a route's targets, each of which may be followed by a
+// colon and its weight.
+func ParseRoute(targets []string) (Route, os.Error) {
+	route := Route{make([]string, len(targets)), nil}
+	for i, target := range targets {
+		parts := strings.Split(target, ":", 2)
+		err := checkRouteAddress(parts[0])
+		if err != nil {
+			return Route{}, err
+		}
+
+		route.Targets[i] = parts[0]
+		if len(parts) == 1 {
+			continue
+		}
+
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil || weight < 1 {
+			return Route{}, os.NewError("invalid route weight: " + target)
+		}
+		if route.Weights == nil {
+			route.Weights = make([]int, len(targets))
+			for j := range route.Weights {
+				route.Weights[j] = 1
+			}
+		}
+		route.Weights[i] = weight
+	}
+	return route, nil
+}
+
+// FormatRoute is the inverse of ParseRoute.
+func FormatRoute(route Route) []string {
+	targets := make([]string, len(route.Targets))
+	for i, target := range route.Targets {
+		targets[i] = target
+		if route.Weights != nil {
+			targets[i] += ":" + strconv.Itoa(route.Weights[i])
+		}
+	}
+	return targets
+}
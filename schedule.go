@@ -0,0 +1,156 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A schedule takes turns between the addresses of a fair Ready, using
+// smooth weighted round-robin: each address with a message waiting earns
+// its weight in credit, the one with the most credit is picked and pays
+// back what was earned in total. Over time each address is picked in
+// proportion to its weight, with the picks spread out rather than bunched.
+//
+// Schedules are kept by the exchange and shared by every fair Ready that
+// waits on the same addresses with the same weights, so a pool of workers
+// listening on "high low" takes turns as a whole. A schedule nobody has
+// used for scheduleIdleTimeout is forgotten.
+type schedule struct {
+	credit   []int
+	lastUsed int64
+}
+
+// in nanoseconds
+const scheduleIdleTimeout = 300e9
+
+// pickScheduled picks one of the eligible addresses by the schedule for
+// addresses and weights, and returns its index, or -1 if none is eligible.
+func (exchange *Exchange) pickScheduled(addresses []string, weights []int, eligible []bool, now int64) int {
+	exchange.scheduleLock.Lock()
+	defer exchange.scheduleLock.Unlock()
+
+	if now - exchange.schedulesPruned > scheduleIdleTimeout {
+		for key, s := range exchange.schedules {
+			if now - s.lastUsed > scheduleIdleTimeout {
+				exchange.schedules[key] = nil, false
+			}
+		}
+		exchange.schedulesPruned = now
+	}
+
+	key := fmt.Sprint(addresses, weights)
+	s, exists := exchange.schedules[key]
+	if !exists {
+		s = &schedule{credit: make([]int, len(addresses))}
+	}
+
+	best := pickWeighted(s.credit, weights, eligible)
+	if best < 0 {
+		return -1
+	}
+
+	s.lastUsed = now
+	exchange.schedules[key] = s
+	return best
+}
+
+// preferring returns addresses with the one at index best moved to the
+// front, or addresses itself if best is -1.
+func preferring(addresses []string, best int) []string {
+	if best < 0 {
+		return addresses
+	}
+
+	preferred := make([]string, 0, len(addresses))
+	preferred = appendString(preferred, addresses[best])
+	for i, address := range addresses {
+		if i != best {
+			preferred = appendString(preferred, address)
+		}
+	}
+	return preferred
+}
+
+// pickQueuedAddress returns the address of the queue rs should take its
+// next message from. Without weights that is the first of its addresses
+// with a message waiting. Only a Ready on a single shard has weights here,
+// since one on several shards takes its turn before it is placed.
+func (shard *exchangeShard) pickQueuedAddress(rs *readyState, now int64) (string, bool) {
+	if rs.weights == nil {
+		for _, onAddress := range rs.onAddresses {
+			if address, exists := shard.findQueuedAddress(onAddress, now); exists {
+				return address, true
+			}
+		}
+		return "", false
+	}
+
+	addresses := make([]string, len(rs.onAddresses))
+	eligible := make([]bool, len(rs.onAddresses))
+	for i, onAddress := range rs.onAddresses {
+		addresses[i], eligible[i] = shard.findQueuedAddress(onAddress, now)
+	}
+
+	best := shard.exchange.pickScheduled(rs.onAddresses, rs.weights, eligible, now)
+	if best < 0 {
+		return "", false
+	}
+	return addresses[best], true
+}
+
+// pickWeighted picks one of the eligible indexes by smooth weighted
+// round-robin, keeping each index's credit in credit, and returns -1 if
+// none is eligible. A nil eligible makes every index eligible.
+func pickWeighted(credit []int, weights []int, eligible []bool) int {
+	total := 0
+	best := -1
+	for i := range credit {
+		if eligible != nil && !eligible[i] {
+			continue
+		}
+
+		credit[i] += weights[i]
+		total += weights[i]
+		if best < 0 || credit[i] > credit[best] {
+			best = i
+		}
+	}
+
+	if best >= 0 {
+		credit[best] -= total
+	}
+	return best
+}
+
+// parseWeights parses a comma-separated list of positive weights, one for
+// each of count addresses.
+func parseWeights(weightsStr string, count int) ([]int, bool) {
+	fields := strings.Split(weightsStr, ",", -1)
+	if len(fields) != count {
+		return nil, false
+	}
+
+	weights := make([]int, count)
+	for i, field := range fields {
+		weight, err := strconv.Atoi(field)
+		if err != nil || weight < 1 {
+			return nil, false
+		}
+		weights[i] = weight
+	}
+	return weights, true
+}
+
+// formatWeights is the inverse of parseWeights.
+func formatWeights(weights []int) string {
+	fields := make([]string, len(weights))
+	for i, weight := range weights {
+		fields[i] = strconv.Itoa(weight)
+	}
+	return strings.Join(fields, ",")
+}
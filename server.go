@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"os"
 	"bufio"
+	"sort"
 )
 
 const (
@@ -19,18 +20,138 @@ const (
 	timeoutCommandStr = "*"
 	quitCommandStr    = "."
 	errorCommandStr   = "-"
+	
+	subscribeCommandStr   = "+"
+	unsubscribeCommandStr = "~"
+	ackCommandStr         = "!"
+	batchCommandStr       = "&"
+	
+	requeueParamStr = "requeue"
+	rejectParamStr  = "reject"
+	
+	// the most messages a batch, sent or received, may hold
+	maxBatchSize = 65536
+	
+	// a mandatory message or a batch is answered with "=" and one of these,
+	// and a batch that fails with "= sent N error", N being how many of its
+	// messages were sent
+	sentStatusStr       = "sent"
+	noListenerStatusStr = "nolistener"
 )
 
+// Admin commands are "@" followed by the name of the command. They are
+// answered with any number of "=" info lines or ">" messages, followed by
+// "*".
+const (
+	adminCommandStr = "@"
+	infoCommandStr  = "="
+	endCommandStr   = "*"
+	
+	listAdminStr   = "list"
+	depthAdminStr  = "depth"
+	peekAdminStr   = "peek"
+	purgeAdminStr  = "purge"
+	routesAdminStr = "routes"
+	routeAdminStr  = "route"
+	
+	defaultPeekCount = 10
+)
+
+const (
+	fanoutOptionStr      = "fanout"
+	priorityOptionStr    = "priority"
+	delayOptionStr       = "delay"
+	notBeforeOptionStr   = "notbefore"
+	ackOptionStr         = "ack"
+	deliveryOptionStr    = "delivery"
+	origToOptionStr      = "origto"
+	reasonOptionStr      = "reason"
+	headersOptionStr     = "headers"
+	fairOptionStr        = "fair"
+	weightsOptionStr     = "weights"
+	mandatoryOptionStr   = "mandatory"
+	batchOptionStr       = "batch"
+	transactionOptionStr = "transaction"
+	quorumOptionStr      = "quorum"
+	streamOptionStr      = "stream"
+	endOfStreamOptionStr = "eos"
+	notifyOptionStr      = "notify"
+)
+
+// the options each command takes
+var (
+	messageOptionNames = []string{fanoutOptionStr, priorityOptionStr, delayOptionStr, notBeforeOptionStr, deliveryOptionStr, origToOptionStr, reasonOptionStr, headersOptionStr, mandatoryOptionStr, endOfStreamOptionStr, notifyOptionStr}
+	queryOptionNames   = []string{fanoutOptionStr, priorityOptionStr, delayOptionStr, notBeforeOptionStr, deliveryOptionStr, origToOptionStr, reasonOptionStr, headersOptionStr, mandatoryOptionStr, endOfStreamOptionStr, notifyOptionStr, quorumOptionStr, streamOptionStr}
+	readyOptionNames   = []string{ackOptionStr, fairOptionStr, weightsOptionStr, batchOptionStr}
+	batchOptionNames   = []string{transactionOptionStr}
+)
+
+// isOptionName reports whether name is the name of any option.
+func isOptionName(name string) bool {
+	for _, names := range [][]string{messageOptionNames, queryOptionNames, readyOptionNames, batchOptionNames} {
+		if hasName(names, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 type Server struct {
 	exchange *Exchange
 	listener net.Listener
 	quitChan chan bool
+	admin    bool
+	owned    bool
 }
 
 func NewServer(exchange *Exchange, network string, laddr string) (server *Server) {
+	return newServer(exchange, network, laddr, false)
+}
+
+// NewAdminServer creates a server whose clients may also use the admin
+// commands, which can see and throw away any queued message. A unix socket
+// is only made accessible to its owner, while a tcp address should be one
+// only operators can reach.
+func NewAdminServer(exchange *Exchange, network string, laddr string) (server *Server) {
+	return newServer(exchange, network, laddr, true)
+}
+
+// delivered returns a copy of msg, as delivered to a client, without the
+// options that only told the exchange how to handle it, so that clients
+// only see the options they asked for: a delivery id when acking, the end
+// of a streamed query's replies, and what became of a dead letter.
+// Clients that predate an option can't read a message that carries it.
+func delivered(msg *Message, streaming bool) *Message {
+	if msg == nil {
+		return nil
+	}
+	
+	m := *msg
+	m.Fanout = false
+	m.Priority = 0
+	m.DelayMillis = 0
+	m.NotBefore = 0
+	m.Mandatory = false
+	m.MandatoryWaitMillis = 0
+	m.NotifyExpiry = false
+	m.EndOfStream = m.EndOfStream && streaming
+	return &m
+}
+
+func newServer(exchange *Exchange, network string, laddr string, admin bool) (server *Server) {
 	server = new(Server)
 	server.exchange = exchange
 	server.quitChan = make(chan bool)
+	server.admin = admin
 	
 	var err os.Error
 	server.listener, err = net.Listen(network, laddr)
@@ -39,7 +160,11 @@ func NewServer(exchange *Exchange, network string, laddr string) (server *Server
 	}
 	
 	if network == "unix" {
-		os.Chmod(laddr, 0777)
+		if admin {
+			os.Chmod(laddr, 0700)
+		} else {
+			os.Chmod(laddr, 0777)
+		}
 	}
 	
 	return
@@ -71,43 +196,199 @@ func (server *Server) Run() {
 	}
 }
 
+// SetOwnedAddresses makes the reply address of each query owned by the
+// connection that sent it, so no other connection may Ready on it, until
+// the query is answered or the connection closes. It must be called
+// before Run.
+func (server *Server) SetOwnedAddresses(owned bool) {
+	server.owned = owned
+}
+
 func (server *Server) Quit() {
 	server.quitChan <- true
 }
 
 func (server *Server) handle(stream *CommandStream) {
-		
+	// messages received with ack=N that haven't been acked yet are requeued
+	// when the connection goes away
+	unacked := make(map[string]bool)
+	
+	// addresses generated for this connection's queries are only its own
+	// to Ready on if the server is set to own them
+	var owner *AddressOwner
+	if server.owned {
+		owner = server.exchange.NewAddressOwner()
+	}
+	
+	// While a Ready or a query waits, a goroutine watches the connection so
+	// the wait can be given up if the client goes away. Only one goroutine
+	// reads from the stream at a time, so the next command isn't read until
+	// the watcher is done.
+	var watchDone chan bool
+	watchClose := func() <-chan bool {
+		closedChan := make(chan bool, 1)
+		watchDone = make(chan bool, 1)
+		go func(done chan bool) {
+			_, err := stream.reader.ReadByte()
+			if err != nil {
+				// closed rather than sent to, since a gathering query
+				// may wait on it more than once
+				close(closedChan)
+			} else {
+				stream.reader.UnreadByte()
+			}
+			done <- true
+		}(watchDone)
+		return closedChan
+	}
+	
+	// giveBack puts back a message that couldn't be written to the client.
+	giveBack := func(msg *Message) {
+		if msg == nil {
+			return
+		}
+		if msg.DeliveryId != "" {
+			server.exchange.Requeue(msg.DeliveryId)
+		} else {
+			server.exchange.returnMessage(msg)
+		}
+	}
+	
 	handleReady := func(params []string) {
+		params, options, err := splitOptions(params, readyOptionNames)
+		if err != nil {
+			stream.WriteError(err); return
+		}
+		
 		if len(params) < 2 {
-			stream.WriteError(os.NewError("ready format: < timeout onAddr1 [onAddr2..onAddrN]")); return
+			stream.WriteError(os.NewError("ready format: < timeout onAddr1 [onAddr2..onAddrN] [ack=N] [fair=1] [weights=W1,..,WN] [batch=N]")); return
 		}
 	
-		timeout, err := strconv.Atoi64(params[0])
+		timeout, err := ParseMillis(params[0])
 		if err != nil {
 			stream.WriteError(os.NewError("invalid timeout format")); return
 		}
 		
-		msg := server.exchange.Ready(timeout, params[1:])
+		if !server.exchange.mayReady(owner, params[1:]) {
+			stream.WriteError(os.NewError("address is owned by another connection")); return
+		}
+		
+		readyOptions := new(ReadyOptions)
+		if ackStr, exists := options[ackOptionStr]; exists {
+			readyOptions.AckTimeoutMillis, err = ParseMillis(ackStr)
+			if err != nil {
+				stream.WriteError(os.NewError("invalid ack timeout format")); return
+			}
+		}
+		
+		readyOptions.Fair = options[fairOptionStr] == "1"
+		
+		if weightsStr, exists := options[weightsOptionStr]; exists {
+			var ok bool
+			readyOptions.Weights, ok = parseWeights(weightsStr, len(params) - 1)
+			if !ok {
+				stream.WriteError(os.NewError("invalid weights format")); return
+			}
+		}
+		
+		if batchStr, exists := options[batchOptionStr]; exists {
+			count, err := strconv.Atoi(batchStr)
+			if err != nil || count < 1 || count > maxBatchSize {
+				stream.WriteError(os.NewError("invalid batch size format")); return
+			}
+			
+			// a batch is answered with each message, then "*"
+			messages := server.exchange.ReadyBatchWith(timeout, params[1:], count, readyOptions, watchClose())
+			for i, msg := range messages {
+				err = stream.WriteMessage(delivered(msg, false))
+				if err != nil {
+					for _, unwritten := range messages[i:] {
+						giveBack(unwritten)
+					}
+					stream.WriteError(err); return
+				}
+				
+				if msg.DeliveryId != "" {
+					unacked[msg.DeliveryId] = true
+				}
+			}
+			
+			err = stream.WriteCommand([]string{endCommandStr})
+			if err != nil {
+				stream.WriteError(err)
+			}
+			return
+		}
+		
+		msg := server.exchange.ReadyWith(timeout, params[1:], readyOptions, watchClose())
 	
-		err = stream.WriteMessage(msg)
+		err = stream.WriteMessage(delivered(msg, false))
 		if err != nil {
+			giveBack(msg)
 			stream.WriteError(err); return
 		}
+		
+		if msg != nil && msg.DeliveryId != "" {
+			unacked[msg.DeliveryId] = true
+		}
 	}
 	
-	handleMessage := func(params []string) {
+	handleAck := func(params []string) {
+		if len(params) < 1 || len(params) > 2 || len(params) == 2 && params[1] != requeueParamStr && params[1] != rejectParamStr {
+			stream.WriteError(os.NewError("ack format: ! deliveryId [requeue|reject]")); return
+		}
+		
+		// a connection may only settle deliveries made to it
+		if !unacked[params[0]] {
+			stream.WriteError(os.NewError("unknown delivery id: " + params[0])); return
+		}
+		unacked[params[0]] = false, false
+		
+		switch {
+		case len(params) == 1:
+			server.exchange.Ack(params[0])
+		case params[1] == requeueParamStr:
+			server.exchange.Requeue(params[0])
+		default:
+			server.exchange.Reject(params[0])
+		}
+	}
+	
+	// readClientContent reads the rest of a message sent by the client. The
+	// fields the exchange sets on delivery are cleared, so a client can't
+	// pass its message off as a redelivery or a dead letter.
+	readClientContent := func(msg *Message, options map[string]string, bodyLen int) os.Error {
+		err := stream.readMessageContent(msg, options, bodyLen)
+		if err != nil {
+			return err
+		}
+		
+		msg.DeliveryId = ""
+		msg.OriginalAddress = ""
+		msg.Reason = ""
+		return nil
+	}
+	
+	// readSentMessage reads the rest of a message sent by the client, whose
+	// command had params
+	readSentMessage := func(params []string) (*Message, os.Error) {
+		params, options, err := splitOptions(params, messageOptionNames)
+		if err != nil {
+			return nil, err
+		}
+		
 		if len(params) < 3 || len(params) > 4 {
-			stream.WriteError(os.NewError("message format: > bodyLen timeout toAddr [replyAddr]")); return
+			return nil, os.NewError("message format: > bodyLen timeout toAddr [replyAddr] [fanout=1] [priority=N] [delay=N] [notbefore=T] [mandatory=N] [notify=1] [headers=N]")
 		}
 	
 		bodyLen, err := strconv.Atoi(params[0])
 		if err != nil {
-			stream.WriteError(os.NewError("invalid body length format")); return
+			return nil, os.NewError("invalid body length format")
 		}
 		
-		timeout, err := strconv.Atoi64(params[1])
+		timeout, err := ParseMillis(params[1])
 		if err != nil {
-			stream.WriteError(os.NewError("invalid timeout format")); return
+			return nil, os.NewError("invalid timeout format")
 		}
 		
 		toAddr := params[2]
@@ -117,21 +398,100 @@ func (server *Server) handle(stream *CommandStream) {
 			replyAddr = params[3]
 		}
 		
-		var body string
+		msg := &Message{ToAddress: toAddr, ReplyAddress: replyAddr, TimeoutMillis: timeout}
+		
+		err = readClientContent(msg, options, bodyLen)
+		if err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+	
+	handleMessage := func(params []string) {
+		msg, err := readSentMessage(params)
+		if err != nil {
+			stream.WriteError(err); return
+		}
+		
+		err = server.exchange.SendMessage(msg)
+		switch {
+		case err == ErrNoListener:
+			err = stream.WriteCommand([]string{infoCommandStr, noListenerStatusStr})
+		case err != nil:
+			stream.WriteError(err); return
+		case msg.Mandatory || msg.MandatoryWaitMillis > 0:
+			err = stream.WriteCommand([]string{infoCommandStr, sentStatusStr})
+		}
+		if err != nil {
+			stream.WriteError(err); return
+		}
+	}
+	
+	handleBatch := func(params []string) {
+		params, options, err := splitOptions(params, batchOptionNames)
+		if err != nil {
+			stream.WriteError(err); return
+		}
 		
-		if bodyLen > 0 {
-			body, err = stream.ReadBody(bodyLen)
+		if len(params) != 1 {
+			stream.WriteError(os.NewError("batch format: & count [transaction=1], followed by count messages")); return
+		}
+		
+		count, err := strconv.Atoi(params[0])
+		if err != nil || count < 0 || count > maxBatchSize {
+			stream.WriteError(os.NewError("invalid batch count format")); return
+		}
+		
+		messages := make([]*Message, count)
+		for i := range messages {
+			command, err := stream.ReadCommand()
+			if err != nil {
+				stream.WriteError(err); return
+			}
+			if len(command) == 0 || command[0] != messageCommandStr {
+				stream.WriteError(os.NewError("batch may only contain messages")); return
+			}
+			
+			messages[i], err = readSentMessage(command[1:])
 			if err != nil {
 				stream.WriteError(err); return
 			}
 		}
 		
-		server.exchange.Send(body, timeout, toAddr, replyAddr)
+		status := []string{infoCommandStr, sentStatusStr}
+		sent, err := server.exchange.SendBatch(messages, options[transactionOptionStr] == "1")
+		if err != nil {
+			// the whole batch has been read, so the connection carries on
+			status = appendString(status, strconv.Itoa(sent))
+			status = appendString(status, err.String())
+		}
+		
+		err = stream.WriteCommand(status)
+		if err != nil {
+			stream.WriteError(err); return
+		}
+	}
+	
+	handleSubscribe := func(params []string, subscribe bool) {
+		if len(params) != 2 {
+			stream.WriteError(os.NewError("subscribe format: + toAddr queueAddr (or ~ to unsubscribe)")); return
+		}
+		
+		if subscribe {
+			server.exchange.Subscribe(params[0], params[1])
+		} else {
+			server.exchange.Unsubscribe(params[0], params[1])
+		}
 	}
 	
 	handleQuery := func(params []string) {
-		if len(params) != 3 {
-			stream.WriteError(os.NewError("query format: ? bodyLen timeout toAddr")); return
+		params, options, err := splitOptions(params, queryOptionNames)
+		if err != nil {
+			stream.WriteError(err); return
+		}
+		
+		if len(params) < 3 {
+			stream.WriteError(os.NewError("query format: ? bodyLen timeout toAddr1 [toAddr2..toAddrN] [priority=N] [notify=1] [headers=N] [quorum=N] [stream=1]")); return
 		}
 	
 		bodyLen, err := strconv.Atoi(params[0])
@@ -139,27 +499,223 @@ func (server *Server) handle(stream *CommandStream) {
 			stream.WriteError(os.NewError("invalid body length format")); return
 		}
 		
-		timeout, err := strconv.Atoi64(params[1])
+		timeout, err := ParseMillis(params[1])
 		if err != nil {
 			stream.WriteError(os.NewError("invalid timeout format")); return
 		}
 		
-		toAddr := params[2]
+		msg := &Message{ToAddress: params[2], TimeoutMillis: timeout}
 		
-		body, err := stream.ReadBody(bodyLen)
+		err = readClientContent(msg, options, bodyLen)
 		if err != nil {
 			stream.WriteError(err); return
 		}
 		
-		msg := server.exchange.Query(body, timeout, toAddr)
+		if options[streamOptionStr] == "1" {
+			if len(params) > 3 {
+				stream.WriteError(os.NewError("a streamed query has a single address")); return
+			}
+			
+			// a streamed query is answered with each reply, up to the one
+			// marked eos=1, or "*" if a reply doesn't arrive in time. An
+			// expiry notice ends the stream, so it is marked eos=1 too.
+			var replies *ReplyStream
+			var replyAddress string
+			if owner != nil {
+				replyAddress = owner.GenerateAddress()
+				replies = server.exchange.queryStream(msg, replyAddress, watchClose())
+			} else {
+				replies = server.exchange.QueryStreamCancel(msg, watchClose())
+			}
+			
+			for replies != nil {
+				replyMsg, err := replies.Next()
+				if replyMsg == nil && err == nil {
+					break
+				}
+				
+				// a nil message is written as "*"
+				err = stream.WriteMessage(delivered(replyMsg, true))
+				if err != nil {
+					giveBack(replyMsg)
+					stream.WriteError(err)
+					break
+				}
+				if replyMsg == nil {
+					break
+				}
+			}
+			if replies == nil {
+				stream.WriteMessage(nil)
+			}
+			
+			if owner != nil {
+				owner.ReleaseAddress(replyAddress)
+			}
+			return
+		}
+		
+		quorumStr, gather := options[quorumOptionStr]
+		if gather || len(params) > 3 {
+			// a gathering query is answered with each reply, then "*"
+			quorum := 0
+			if gather {
+				quorum, err = strconv.Atoi(quorumStr)
+				if err != nil || quorum < 0 {
+					stream.WriteError(os.NewError("invalid quorum format")); return
+				}
+			}
+			
+			var replies []*Message
+			if owner != nil {
+				replyAddress := owner.GenerateAddress()
+				replies = server.exchange.queryAll(msg, params[2:], quorum, replyAddress, watchClose())
+				owner.ReleaseAddress(replyAddress)
+			} else {
+				replies = server.exchange.QueryAllCancel(msg, params[2:], quorum, watchClose())
+			}
+			
+			for i, replyMsg := range replies {
+				err = stream.WriteMessage(delivered(replyMsg, false))
+				if err != nil {
+					for _, unwritten := range replies[i:] {
+						giveBack(unwritten)
+					}
+					stream.WriteError(err); return
+				}
+			}
+			
+			err = stream.WriteCommand([]string{endCommandStr})
+			if err != nil {
+				stream.WriteError(err)
+			}
+			return
+		}
+		
+		var replyMsg *Message
+		if owner != nil {
+			replyAddress := owner.GenerateAddress()
+			replyMsg = server.exchange.query(msg, replyAddress, watchClose())
+			owner.ReleaseAddress(replyAddress)
+		} else {
+			replyMsg = server.exchange.QueryCancel(msg, watchClose())
+		}
 		
-		err = stream.WriteMessage(msg)
+		err = stream.WriteMessage(delivered(replyMsg, false))
 		if err != nil {
+			giveBack(replyMsg)
 			stream.WriteError(err); return
 		}
 	}
 
+	writeAddressInfo := func(address string, addressStats *AddressStats) os.Error {
+		return stream.WriteCommand([]string{infoCommandStr, address, strconv.Itoa(addressStats.Queued), strconv.Itoa(addressStats.Waiting), FormatMillis(addressStats.OldestMillis)})
+	}
+	
+	handleAdmin := func(params []string) {
+		if !server.admin {
+			stream.WriteError(os.NewError("admin commands are not allowed on this connection")); return
+		}
+		
+		var err os.Error
+		
+		switch {
+		case len(params) == 1 && params[0] == listAdminStr:
+			stats := server.exchange.Stats()
+			
+			addresses := make([]string, 0, len(stats.Addresses))
+			for address := range stats.Addresses {
+				addresses = appendString(addresses, address)
+			}
+			sort.SortStrings(addresses)
+			
+			for _, address := range addresses {
+				err = writeAddressInfo(address, stats.Addresses[address])
+				if err != nil {
+					break
+				}
+			}
+		
+		case len(params) == 2 && params[0] == depthAdminStr:
+			addressStats, exists := server.exchange.Stats().Addresses[params[1]]
+			if !exists {
+				addressStats = new(AddressStats)
+			}
+			err = writeAddressInfo(params[1], addressStats)
+		
+		case (len(params) == 2 || len(params) == 3) && params[0] == peekAdminStr:
+			count := defaultPeekCount
+			if len(params) == 3 {
+				count, err = strconv.Atoi(params[2])
+				if err != nil || count < 0 {
+					stream.WriteError(os.NewError("invalid peek count format")); return
+				}
+			}
+			
+			for _, msg := range server.exchange.Peek(params[1], count) {
+				err = stream.WriteMessage(msg)
+				if err != nil {
+					break
+				}
+			}
+		
+		case len(params) == 2 && params[0] == purgeAdminStr:
+			purged := server.exchange.Purge(params[1])
+			err = stream.WriteCommand([]string{infoCommandStr, params[1], strconv.Itoa(purged)})
+		
+		case len(params) == 1 && params[0] == routesAdminStr:
+			routes := server.exchange.Routes()
+			
+			addresses := make([]string, 0, len(routes))
+			for address := range routes {
+				addresses = appendString(addresses, address)
+			}
+			sort.SortStrings(addresses)
+			
+			for _, address := range addresses {
+				info := []string{infoCommandStr, address}
+				for _, target := range FormatRoute(routes[address]) {
+					info = appendString(info, target)
+				}
+				err = stream.WriteCommand(info)
+				if err != nil {
+					break
+				}
+			}
+		
+		case len(params) >= 2 && params[0] == routeAdminStr:
+			// a route with no targets is removed
+			if len(params) == 2 {
+				server.exchange.RemoveRoute(params[1])
+				break
+			}
+			
+			route, routeErr := ParseRoute(params[2:])
+			if routeErr == nil {
+				routeErr = server.exchange.SetRoute(params[1], route)
+			}
+			if routeErr != nil {
+				stream.WriteError(routeErr); return
+			}
+		
+		default:
+			stream.WriteError(os.NewError("admin format: @ list | @ depth addr | @ peek addr [count] | @ purge addr | @ routes | @ route addr [target1[:weight1]..targetN[:weightN]]")); return
+		}
+		
+		if err == nil {
+			err = stream.WriteCommand([]string{endCommandStr})
+		}
+		if err != nil {
+			stream.WriteError(err); return
+		}
+	}
+	
 	for !stream.closed {
+		if watchDone != nil {
+			<-watchDone
+			watchDone = nil
+		}
+		
 		command, err := stream.ReadCommand()
 		if err != nil {
 			stream.WriteError(err)
@@ -171,12 +727,30 @@ func (server *Server) handle(stream *CommandStream) {
 			handleReady(command[1:])
 		case messageCommandStr:
 			handleMessage(command[1:])
+		case batchCommandStr:
+			handleBatch(command[1:])
 		case queryCommandStr:
 			handleQuery(command[1:])
+		case subscribeCommandStr:
+			handleSubscribe(command[1:], true)
+		case unsubscribeCommandStr:
+			handleSubscribe(command[1:], false)
+		case ackCommandStr:
+			handleAck(command[1:])
+		case adminCommandStr:
+			handleAdmin(command[1:])
 		case quitCommandStr:
 			stream.Close()	
 		default:
 			stream.WriteError(os.NewError("invalid command"))
 		}
 	}
+	
+	for deliveryId := range unacked {
+		server.exchange.Requeue(deliveryId)
+	}
+	
+	if owner != nil {
+		owner.Release()
+	}
 }
@@ -0,0 +1,399 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"container/list"
+	"container/vector"
+	"hash/crc32"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// shardFor returns the shard that owns address.
+func (exchange *Exchange) shardFor(address string) *exchangeShard {
+	return exchange.shards[crc32.ChecksumIEEE([]byte(address)) % uint32(len(exchange.shards))]
+}
+
+// deliveryShard returns the shard that handed out deliveryId. Delivery ids
+// are counted in steps of the number of shards, so that is the id modulo
+// the number of shards.
+func (exchange *Exchange) deliveryShard(deliveryId string) *exchangeShard {
+	n, err := strconv.Btoui64(deliveryId, 16)
+	if err != nil {
+		// no shard knows it, so any of them can ignore it
+		return exchange.shards[0]
+	}
+	return exchange.shards[n % uint64(len(exchange.shards))]
+}
+
+// route handles m, a message the exchange sends itself, on the shard that
+// owns its address once any route has been followed, which may be this
+// one. Other shards are sent m through a forwarder, so shards never wait
+// on each other.
+func (shard *exchangeShard) route(m Message) {
+	m.ToAddress = shard.exchange.resolve(m.ToAddress)
+	target := shard.exchange.shardFor(m.ToAddress)
+	if target == shard {
+		shard.handleMessage(m)
+		return
+	}
+
+	f, exists := shard.forwarders[target]
+	if !exists {
+		f = &forwarder{queue: list.New(), target: target}
+		shard.forwarders[target] = f
+	}
+	f.forward(m)
+}
+
+// A forwarder passes the messages one shard routes to another on to it in
+// the order they were routed, so broadcast copies and dead letters reach
+// their queues in order. A single goroutine does the passing while there
+// are messages waiting, so the routing shard never blocks.
+type forwarder struct {
+	lock    sync.Mutex
+	queue   *list.List
+	running bool
+	target  *exchangeShard
+}
+
+func (f *forwarder) forward(m Message) {
+	f.lock.Lock()
+	f.queue.PushBack(m)
+	start := !f.running
+	f.running = true
+	f.lock.Unlock()
+
+	if start {
+		go f.run()
+	}
+}
+
+func (f *forwarder) run() {
+	for {
+		f.lock.Lock()
+		if f.queue.Len() == 0 {
+			f.running = false
+			f.lock.Unlock()
+			return
+		}
+		e := f.queue.Front()
+		f.queue.Remove(e)
+		f.lock.Unlock()
+
+		f.target.forwardChan <- e.Value.(Message)
+	}
+}
+
+// A waiter is a client blocked in Ready. It has a ready state on each shard
+// that owns one of its addresses, and on every shard for each pattern, and
+// is answered by whichever shard claims it first.
+type waiter struct {
+	lock        sync.Mutex
+	claimed     bool
+	readyStates []*readyState
+	// buffered so that the claiming shard never blocks, and sent nil when
+	// the Ready times out
+	messageChan chan []Message
+	// sent to by each shard once it has handled its ready state, and
+	// buffered so that it never blocks
+	placedChan  chan bool
+}
+
+// newWaiter creates a waiter for onAddresses that takes up to count
+// messages at once. weights is nil, or holds a weight for each of
+// onAddresses, which goes with it to its shards. The ready states are in
+// the order of the first of onAddresses each shard owns.
+func (exchange *Exchange) newWaiter(onAddresses []string, weights []int, count int, timeout int64, ackTimeout int64) *waiter {
+	w := &waiter{messageChan: make(chan []Message, 1)}
+
+	byShard := make(map[*exchangeShard]*readyState)
+	addTo := func(shard *exchangeShard, i int) {
+		rs, exists := byShard[shard]
+		if !exists {
+			rs = &readyState{count: count, timeout: timeout, ackTimeout: ackTimeout, waiter: w, shard: shard}
+			if weights != nil {
+				rs.weights = make([]int, 0, len(weights))
+			}
+			byShard[shard] = rs
+			w.readyStates = appendReadyState(w.readyStates, rs)
+		}
+		rs.onAddresses = appendString(rs.onAddresses, onAddresses[i])
+		rs.indexes = appendInt(rs.indexes, i)
+		if weights != nil {
+			rs.weights = rs.weights[0:len(rs.weights)+1]
+			rs.weights[len(rs.weights)-1] = weights[i]
+		}
+	}
+
+	for i, onAddress := range onAddresses {
+		if isPattern(onAddress) {
+			for _, shard := range exchange.shards {
+				addTo(shard, i)
+			}
+		} else {
+			addTo(exchange.shardFor(onAddress), i)
+		}
+	}
+	
+	if len(w.readyStates) == 0 {
+		// waiting on nothing still waits until the timeout
+		rs := &readyState{count: count, timeout: timeout, ackTimeout: ackTimeout, waiter: w, shard: exchange.shards[0]}
+		w.readyStates = appendReadyState(w.readyStates, rs)
+	}
+
+	w.placedChan = make(chan bool, len(w.readyStates))
+	return w
+}
+
+func appendReadyState(slice []*readyState, rs *readyState) []*readyState {
+	if len(slice) == cap(slice) {
+		newSlice := make([]*readyState, len(slice), 2 * len(slice) + 1)
+		copy(newSlice, slice)
+		slice = newSlice
+	}
+	slice = slice[0:len(slice)+1]
+	slice[len(slice)-1] = rs
+	return slice
+}
+
+func appendInt(slice []int, n int) []int {
+	if len(slice) == cap(slice) {
+		newSlice := make([]int, len(slice), 2 * len(slice) + 1)
+		copy(newSlice, slice)
+		slice = newSlice
+	}
+	slice = slice[0:len(slice)+1]
+	slice[len(slice)-1] = n
+	return slice
+}
+
+// probe asks every shard w is on which of its addresses have messages
+// queued, without placing w, and returns the answer for each of w's count
+// addresses.
+func (w *waiter) probe(count int) []bool {
+	for _, rs := range w.readyStates {
+		rs.probe = true
+		rs.shard.readyStateChan <- rs
+	}
+
+	eligible := make([]bool, count)
+	for _, rs := range w.readyStates {
+		<-w.placedChan
+		for j, i := range rs.indexes {
+			eligible[i] = eligible[i] || rs.eligible[j]
+		}
+	}
+	return eligible
+}
+
+// probeReadyState answers a probe.
+func (shard *exchangeShard) probeReadyState(rs *readyState) {
+	now := time.Nanoseconds()
+	rs.eligible = make([]bool, len(rs.onAddresses))
+	for j, onAddress := range rs.onAddresses {
+		_, rs.eligible[j] = shard.findQueuedAddress(onAddress, now)
+	}
+}
+
+// place sends w's ready states to their shards. A waiter on more than one
+// shard is placed one shard at a time, in the order of its addresses,
+// each shard handling its ready state before the next is sent, so a
+// message already queued on an earlier address is preferred to one on a
+// later address, as it is within a shard. Placing stops once a shard has
+// answered w.
+func (w *waiter) place() {
+	for _, rs := range w.readyStates {
+		rs.shard.readyStateChan <- rs
+		if len(w.readyStates) == 1 {
+			return
+		}
+
+		<-w.placedChan
+		if w.isClaimed() {
+			return
+		}
+	}
+}
+
+func (w *waiter) isClaimed() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.claimed
+}
+
+// claim marks w as answered and reports whether it wasn't already.
+func (w *waiter) claim() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	claimed := w.claimed
+	w.claimed = true
+	return !claimed
+}
+
+// cancel withdraws w from every shard, unless a shard has already claimed
+// it, and reports whether it did.
+func (w *waiter) cancel() bool {
+	if !w.claim() {
+		return false
+	}
+
+	for _, rs := range w.readyStates {
+		rs.shard.cancelChan <- rs
+	}
+	return true
+}
+
+// claim reports whether rs's waiter is now this shard's to answer. When it
+// is, the waiter's ready states on other shards are cancelled.
+func (shard *exchangeShard) claim(rs *readyState) bool {
+	w := rs.waiter
+	if !w.claim() {
+		return false
+	}
+
+	for _, other := range w.readyStates {
+		if other != rs {
+			go func(other *readyState) {
+				other.shard.cancelChan <- other
+			}(other)
+		}
+	}
+	return true
+}
+
+// claimReadyState unqueues and claims the ready state that has been waiting
+// longest on address, dropping any whose waiter was answered by another
+// shard, and returns nil if there is none.
+func (shard *exchangeShard) claimReadyState(address string) *readyState {
+	for rs := shard.oldestReadyState(address); rs != nil; rs = shard.oldestReadyState(address) {
+		shard.unqueueReadyState(rs)
+		if shard.claim(rs) {
+			return rs
+		}
+	}
+	return nil
+}
+
+// handleCancel unqueues a ready state whose waiter was answered by another
+// shard or gave up. It may arrive before the ready state itself, which
+// then finds its waiter claimed and is never queued.
+func (shard *exchangeShard) handleCancel(rs *readyState) {
+	if rs.queueElements != nil {
+		shard.unqueueReadyState(rs)
+	}
+}
+
+// queueTotals counts the messages queued on all shards together, for the
+// exchange-wide limit, and the senders blocked waiting for room.
+type queueTotals struct {
+	lock    sync.Mutex
+	count   int
+	bytes   int
+	blocked int
+}
+
+// add adjusts the totals and reports whether room was made while senders
+// were blocked.
+func (totals *queueTotals) add(count int, bytes int) bool {
+	totals.lock.Lock()
+	defer totals.lock.Unlock()
+
+	totals.count += count
+	totals.bytes += bytes
+	return count < 0 && totals.blocked > 0
+}
+
+// reserve counts m as queued, unless that would exceed limit, and reports
+// whether it did. Checking and counting under the same lock keeps shards
+// sending at the same moment from overfilling the exchange between them.
+func (totals *queueTotals) reserve(limit *QueueLimit, m *Message) bool {
+	totals.lock.Lock()
+	defer totals.lock.Unlock()
+
+	if limit.exceededBy(totals.count, totals.bytes, m) {
+		return false
+	}
+	totals.count++
+	totals.bytes += len(m.Body)
+	return true
+}
+
+func (totals *queueTotals) addBlocked(blocked int) {
+	totals.lock.Lock()
+	totals.blocked += blocked
+	totals.lock.Unlock()
+}
+
+// wakeShards makes every shard check whether its blocked senders now fit.
+func (exchange *Exchange) wakeShards() {
+	for _, shard := range exchange.shards {
+		select {
+		case shard.wakeChan <- true:
+		default:
+			// already due to wake
+		}
+	}
+}
+
+// A compaction pauses every shard while the journal is rewritten, since
+// the rewrite needs all of their messages at once.
+type compaction struct {
+	states chan *journalState
+	resume chan bool
+}
+
+func (shard *exchangeShard) handlePause(c *compaction) {
+	state := &journalState{make([]Message, 0, 16), make(map[string]*vector.StringVector)}
+	shard.snapshot(state)
+	c.states <- state
+	<-c.resume
+}
+
+// compactJournal rewrites the journal so it holds only the messages that
+// are currently queued, delayed or in flight.
+func (exchange *Exchange) compactJournal() {
+	exchange.pauseLock.Lock()
+	defer exchange.pauseLock.Unlock()
+	
+	c := &compaction{make(chan *journalState), make(chan bool)}
+	for _, shard := range exchange.shards {
+		go func(shard *exchangeShard) {
+			shard.pauseChan <- c
+		}(shard)
+	}
+
+	state := &journalState{make([]Message, 0, 16), make(map[string]*vector.StringVector)}
+	for i := 0; i < len(exchange.shards); i++ {
+		shardState := <-c.states
+		for _, m := range shardState.messages {
+			state.messages = appendMessage(state.messages, m)
+		}
+		for toAddress, queueAddresses := range shardState.subscribers {
+			state.subscribers[toAddress] = queueAddresses
+		}
+	}
+
+	err := exchange.journal.compact(state)
+	close(c.resume)
+
+	if err != nil {
+		exchange.shards[0].journalError(err)
+	}
+}
+
+func appendMessage(slice []Message, m Message) []Message {
+	if len(slice) == cap(slice) {
+		newSlice := make([]Message, len(slice), 2 * len(slice) + 1)
+		copy(newSlice, slice)
+		slice = newSlice
+	}
+	slice = slice[0:len(slice)+1]
+	slice[len(slice)-1] = m
+	return slice
+}
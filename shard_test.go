@@ -0,0 +1,115 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// the shards and threads the sharded benchmarks use, and the addresses
+// they spread their messages over
+const (
+	benchShards    = 4
+	benchAddresses = 16
+)
+
+func newBenchExchange(shardCount int) *Exchange {
+	exchange := newExchange(shardCount)
+	exchange.SetLogLevel(LogLevelMinimal)
+	exchange.Start()
+	return exchange
+}
+
+func benchAddressList() []string {
+	addresses := make([]string, benchAddresses)
+	for i := range addresses {
+		addresses[i] = "bench." + strconv.Itoa(i)
+	}
+	return addresses
+}
+
+// benchmarkSend sends b.N messages, spread over the bench addresses by
+// one goroutine for each, and leaves them queued.
+func benchmarkSend(b *testing.B, shardCount int) {
+	b.StopTimer()
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(benchShards))
+	exchange := newBenchExchange(shardCount)
+	addresses := benchAddressList()
+	body := []byte("benchmark")
+	done := make(chan bool)
+	b.StartTimer()
+
+	for i, address := range addresses {
+		go func(i int, address string) {
+			for n := i; n < b.N; n += len(addresses) {
+				err := exchange.SendMessage(&Message{ToAddress: address, TimeoutMillis: 60000, Body: body})
+				if err != nil {
+					panic(err.String())
+				}
+			}
+			done <- true
+		}(i, address)
+	}
+
+	for _ = range addresses {
+		<-done
+	}
+}
+
+// benchmarkSendReady sends b.N messages as benchmarkSend does, while
+// another goroutine for each address takes them off with Ready.
+func benchmarkSendReady(b *testing.B, shardCount int) {
+	b.StopTimer()
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(benchShards))
+	exchange := newBenchExchange(shardCount)
+	addresses := benchAddressList()
+	body := []byte("benchmark")
+	done := make(chan bool)
+	b.StartTimer()
+
+	for i, address := range addresses {
+		go func(i int, address string) {
+			for n := i; n < b.N; n += len(addresses) {
+				err := exchange.SendMessage(&Message{ToAddress: address, TimeoutMillis: 60000, Body: body})
+				if err != nil {
+					panic(err.String())
+				}
+			}
+			done <- true
+		}(i, address)
+
+		go func(i int, address string) {
+			for n := i; n < b.N; n += len(addresses) {
+				if exchange.Ready(60000, []string{address}) == nil {
+					panic("ready timed out on " + address)
+				}
+			}
+			done <- true
+		}(i, address)
+	}
+
+	for _ = range addresses {
+		<-done
+		<-done
+	}
+}
+
+func BenchmarkSendOneShard(b *testing.B) {
+	benchmarkSend(b, 1)
+}
+
+func BenchmarkSendShards(b *testing.B) {
+	benchmarkSend(b, benchShards)
+}
+
+func BenchmarkSendReadyOneShard(b *testing.B) {
+	benchmarkSendReady(b, 1)
+}
+
+func BenchmarkSendReadyShards(b *testing.B) {
+	benchmarkSendReady(b, benchShards)
+}
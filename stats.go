@@ -0,0 +1,115 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"time"
+)
+
+// AddressStats describes an address that has messages queued on it or
+// clients waiting on it. Addresses that clients wait on with a pattern
+// are listed under the pattern.
+type AddressStats struct {
+	Queued       int
+	QueuedBytes  int
+	OldestMillis int64
+	Waiting      int
+}
+
+// Stats is a snapshot of an exchange. Sent counts every message the
+// exchange has handled, including copies queued for subscribers and dead
+// letters, Delivered counts messages handed to waiting clients, Expired
+// counts messages that timed out before being delivered and Timeouts
+// counts clients whose Ready timed out. The counts start from zero when
+// the exchange is created.
+type Stats struct {
+	Addresses map[string]*AddressStats
+	Sent      uint64
+	Delivered uint64
+	Expired   uint64
+	Timeouts  uint64
+	Delayed   int
+	InFlight  int
+	Blocked   int
+}
+
+// Stats returns a snapshot of the exchange. Each shard takes its part of
+// the snapshot between handling other requests, so the parts are each
+// consistent but may be a moment apart.
+func (exchange *Exchange) Stats() *Stats {
+	stats := &Stats{Addresses: make(map[string]*AddressStats)}
+
+	replyChan := make(chan *Stats)
+	for _, shard := range exchange.shards {
+		shard.statsChan <- replyChan
+		stats.merge(<-replyChan)
+	}
+
+	return stats
+}
+
+func (shard *exchangeShard) stats() *Stats {
+	stats := &Stats{
+		Addresses: make(map[string]*AddressStats),
+		Sent:      shard.sentCount,
+		Delivered: shard.deliveredCount,
+		Expired:   shard.expiredCount,
+		Timeouts:  shard.timeoutCount,
+		Delayed:   shard.delayedMessages.Len(),
+		InFlight:  len(shard.inFlight),
+		Blocked:   shard.blockedCount,
+	}
+
+	now := time.Nanoseconds()
+	for address, messageQueue := range shard.messageQueues {
+		addressStats := stats.address(address)
+		addressStats.Queued = messageQueue.Len()
+		addressStats.QueuedBytes = shard.queueBytes[address]
+
+		// the queue is in delivery order, so the oldest could be anywhere
+		for i := 0; i < messageQueue.Len(); i++ {
+			age := (now - messageQueue.At(i).(Message).notBefore) / 1e6
+			if age > addressStats.OldestMillis {
+				addressStats.OldestMillis = age
+			}
+		}
+	}
+
+	for address, readyStateQueue := range shard.readyStateQueues {
+		stats.address(address).Waiting = readyStateQueue.Len()
+	}
+
+	return stats
+}
+
+func (stats *Stats) address(address string) *AddressStats {
+	addressStats, exists := stats.Addresses[address]
+	if !exists {
+		addressStats = new(AddressStats)
+		stats.Addresses[address] = addressStats
+	}
+	return addressStats
+}
+
+// merge adds a shard's stats to stats. Each address belongs to a single
+// shard, except that clients waiting on a pattern wait on every shard.
+func (stats *Stats) merge(shardStats *Stats) {
+	stats.Sent += shardStats.Sent
+	stats.Delivered += shardStats.Delivered
+	stats.Expired += shardStats.Expired
+	stats.Timeouts += shardStats.Timeouts
+	stats.Delayed += shardStats.Delayed
+	stats.InFlight += shardStats.InFlight
+	stats.Blocked += shardStats.Blocked
+
+	for address, shardAddressStats := range shardStats.Addresses {
+		addressStats, exists := stats.Addresses[address]
+		if !exists {
+			stats.Addresses[address] = shardAddressStats
+		} else if shardAddressStats.Waiting > addressStats.Waiting {
+			addressStats.Waiting = shardAddressStats.Waiting
+		}
+	}
+}
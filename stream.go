@@ -12,6 +12,33 @@ import (
 	"strings"
 )
 
+// the most headers a single message may carry
+const maxMessageHeaders = 1024
+
+// Timeouts and delays on the wire are whole seconds, as they always have
+// been, or milliseconds when followed by millisSuffix, as in "250ms".
+const millisSuffix = "ms"
+
+// ParseMillis parses a timeout in wire format and returns it in
+// milliseconds.
+func ParseMillis(s string) (int64, os.Error) {
+	if strings.HasSuffix(s, millisSuffix) {
+		return strconv.Atoi64(s[0:len(s)-len(millisSuffix)])
+	}
+	
+	seconds, err := strconv.Atoi64(s)
+	return seconds * 1000, err
+}
+
+// FormatMillis formats a timeout in milliseconds in wire format, using
+// whole seconds when it can so older clients still understand it.
+func FormatMillis(millis int64) string {
+	if millis % 1000 == 0 {
+		return strconv.Itoa64(millis / 1000)
+	}
+	return strconv.Itoa64(millis) + millisSuffix
+}
+
 type CommandStream struct {
 	reader *bufio.Reader
 	writer io.WriteCloser
@@ -27,30 +54,171 @@ func (stream *CommandStream) ReadCommand() ([]string, os.Error) {
 	return strings.Fields(strings.TrimSpace(line)), nil
 }
 
-func (stream *CommandStream) ReadBody(bodyLen int) (string, os.Error) {
+// splitOptions separates the name=value options in a command's parameters
+// from its positional parameters. Only the options named in names are
+// taken as options, so an address may contain "=", but a parameter naming
+// an option the command doesn't take is an error rather than an address.
+func splitOptions(params []string, names []string) ([]string, map[string]string, os.Error) {
+	positional := make([]string, 0, len(params))
+	options := make(map[string]string)
+	
+	for _, param := range params {
+		i := strings.Index(param, "=")
+		switch {
+		case i > 0 && hasName(names, param[0:i]):
+			options[param[0:i]] = param[i+1:]
+		case i > 0 && isOptionName(param[0:i]):
+			return nil, nil, os.NewError("option not allowed here: " + param[0:i])
+		default:
+			positional = appendString(positional, param)
+		}
+	}
+	
+	return positional, options, nil
+}
+
+func appendString(slice []string, s string) []string {
+	if len(slice) == cap(slice) {
+		newSlice := make([]string, len(slice), 2 * len(slice) + 1)
+		copy(newSlice, slice)
+		slice = newSlice
+	}
+	slice = slice[0:len(slice)+1]
+	slice[len(slice)-1] = s
+	return slice
+}
+
+// messageOptions returns the options that describe msg on the wire.
+func messageOptions(msg *Message) []string {
+	options := make([]string, 0, 2)
+	
+	if msg.Fanout {
+		options = appendString(options, fanoutOptionStr + "=1")
+	}
+	
+	if msg.Priority != 0 {
+		options = appendString(options, priorityOptionStr + "=" + strconv.Itoa(msg.Priority))
+	}
+	
+	if msg.DelayMillis != 0 {
+		options = appendString(options, delayOptionStr + "=" + FormatMillis(msg.DelayMillis))
+	}
+	
+	if msg.NotBefore != 0 {
+		options = appendString(options, notBeforeOptionStr + "=" + strconv.Itoa64(msg.NotBefore))
+	}
+	
+	if msg.DeliveryId != "" {
+		options = appendString(options, deliveryOptionStr + "=" + msg.DeliveryId)
+	}
+	
+	if msg.OriginalAddress != "" {
+		options = appendString(options, origToOptionStr + "=" + msg.OriginalAddress)
+	}
+	
+	if msg.Reason != "" {
+		options = appendString(options, reasonOptionStr + "=" + msg.Reason)
+	}
+	
+	if msg.NotifyExpiry {
+		options = appendString(options, notifyOptionStr + "=1")
+	}
+	
+	if msg.EndOfStream {
+		options = appendString(options, endOfStreamOptionStr + "=1")
+	}
+	
+	if msg.Mandatory || msg.MandatoryWaitMillis > 0 {
+		options = appendString(options, mandatoryOptionStr + "=" + FormatMillis(msg.MandatoryWaitMillis))
+	}
+	
+	if len(msg.Headers) > 0 {
+		options = appendString(options, headersOptionStr + "=" + strconv.Itoa(len(msg.Headers)))
+	}
+	
+	return options
+}
+
+// readMessageOptions sets the fields of msg described by options.
+func readMessageOptions(msg *Message, options map[string]string) os.Error {
+	msg.Fanout = options[fanoutOptionStr] == "1"
+	msg.EndOfStream = options[endOfStreamOptionStr] == "1"
+	msg.NotifyExpiry = options[notifyOptionStr] == "1"
+	
+	if priorityStr, exists := options[priorityOptionStr]; exists {
+		priority, err := strconv.Atoi(priorityStr)
+		if err != nil {
+			return os.NewError("invalid priority format")
+		}
+		msg.Priority = priority
+	}
+	
+	if delayStr, exists := options[delayOptionStr]; exists {
+		delay, err := ParseMillis(delayStr)
+		if err != nil {
+			return os.NewError("invalid delay format")
+		}
+		msg.DelayMillis = delay
+	}
+	
+	if notBeforeStr, exists := options[notBeforeOptionStr]; exists {
+		notBefore, err := strconv.Atoi64(notBeforeStr)
+		if err != nil {
+			return os.NewError("invalid notbefore format")
+		}
+		msg.NotBefore = notBefore
+	}
+	
+	if waitStr, exists := options[mandatoryOptionStr]; exists {
+		wait, err := ParseMillis(waitStr)
+		if err != nil {
+			return os.NewError("invalid mandatory format")
+		}
+		msg.Mandatory = true
+		msg.MandatoryWaitMillis = wait
+	}
+	
+	msg.DeliveryId = options[deliveryOptionStr]
+	msg.OriginalAddress = options[origToOptionStr]
+	msg.Reason = options[reasonOptionStr]
+	
+	return nil
+}
+
+// ReadBody reads a body of exactly bodyLen bytes, which may contain any
+// bytes at all, followed by \r\n.
+func (stream *CommandStream) ReadBody(bodyLen int) ([]byte, os.Error) {
 	bodyBuf := make([]byte, bodyLen + 2)
 	_, err := io.ReadFull(stream.reader, bodyBuf)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	
 	if bodyBuf[bodyLen] != '\r' || bodyBuf[bodyLen+1] != '\n' {
-		return "", os.NewError("body must be followed by \\r\\n")
+		return nil, os.NewError("body must be followed by \\r\\n")
 	}
 	
-	return string(bodyBuf[0:bodyLen]), nil
+	return bodyBuf[0:bodyLen], nil
 }
 
 func (stream *CommandStream) ReadMessage() (*Message, os.Error) {
 	inCommand, err := stream.ReadCommand()
+	if err != nil {
+		return nil, err
+	}
 	
-	if inCommand[0] == timeoutCommandStr {
+	if len(inCommand) == 0 {
+		return nil, os.NewError("invalid message from server")
+	} else if inCommand[0] == timeoutCommandStr {
 		return nil, nil
 	} else if inCommand[0] != messageCommandStr {
 		return nil, os.NewError("invalid message from server")
 	}
 	
-	params := inCommand[1:]
+	params, options, err := splitOptions(inCommand[1:], messageOptionNames)
+	if err != nil {
+		return nil, err
+	}
 	
 	if len(params) < 3 || len(params) > 4 {
 		return nil, os.NewError("invalid message from server")
@@ -61,7 +229,7 @@ func (stream *CommandStream) ReadMessage() (*Message, os.Error) {
 		return nil, os.NewError("invalid message from server")
 	}
 	
-	timeout, err := strconv.Atoi64(params[1])
+	timeout, err := ParseMillis(params[1])
 	if err != nil {
 		return nil, os.NewError("invalid message from server")
 	}
@@ -73,16 +241,103 @@ func (stream *CommandStream) ReadMessage() (*Message, os.Error) {
 		replyAddr = params[3]
 	}
 	
-	var body string
+	msg := &Message{ToAddress: toAddr, ReplyAddress: replyAddr, TimeoutMillis: timeout}
+	
+	err = stream.readMessageContent(msg, options, bodyLen)
+	if err != nil {
+		return nil, err
+	}
+	
+	return msg, nil
+}
+
+// readMessageContent sets the fields of msg described by the options on
+// its command line, then reads the headers and body that follow it.
+func (stream *CommandStream) readMessageContent(msg *Message, options map[string]string, bodyLen int) os.Error {
+	err := readMessageOptions(msg, options)
+	if err != nil {
+		return err
+	}
+	
+	if headerCountStr, exists := options[headersOptionStr]; exists {
+		headerCount, err := strconv.Atoi(headerCountStr)
+		if err != nil || headerCount < 0 || headerCount > maxMessageHeaders {
+			return os.NewError("invalid header count")
+		}
+		
+		msg.Headers, err = stream.ReadHeaders(headerCount)
+		if err != nil {
+			return err
+		}
+	}
 	
 	if bodyLen > 0 {
-		body, err = stream.ReadBody(bodyLen)
+		msg.Body, err = stream.ReadBody(bodyLen)
+		if err != nil {
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// ReadHeaders reads headerCount lines of the form "key: value".
+func (stream *CommandStream) ReadHeaders(headerCount int) (map[string]string, os.Error) {
+	headers := make(map[string]string)
+	
+	for i := 0; i < headerCount; i++ {
+		line, err := stream.reader.ReadString('\n')
 		if err != nil {
 			return nil, err
 		}
+		
+		kv := strings.Split(strings.TrimRight(line, "\r\n"), ":", 2)
+		if len(kv) != 2 || !validHeaderKey(kv[0]) {
+			return nil, os.NewError("header must be formatted as key: value")
+		}
+		
+		// only the space written after the colon is dropped, so values
+		// keep any space of their own
+		value := kv[1]
+		if strings.HasPrefix(value, " ") {
+			value = value[1:]
+		}
+		headers[kv[0]] = value
+	}
+	
+	return headers, nil
+}
+
+func validHeaderKey(key string) bool {
+	return key != "" && strings.IndexAny(key, " \t\r\n:") < 0
+}
+
+// checkHeaders makes sure headers can be written on the wire: keys can't
+// be empty or contain whitespace or colons, and values can't contain line
+// breaks.
+func checkHeaders(headers map[string]string) os.Error {
+	if len(headers) > maxMessageHeaders {
+		return os.NewError("too many headers")
+	}
+	
+	for key, value := range headers {
+		if !validHeaderKey(key) || strings.IndexAny(value, "\r\n") >= 0 {
+			return os.NewError("invalid header: " + key)
+		}
+	}
+	
+	return nil
+}
+
+func (stream *CommandStream) writeHeaders(headers map[string]string) os.Error {
+	for key, value := range headers {
+		_, err := io.WriteString(stream.writer, key + ": " + value + "\r\n")
+		if err != nil {
+			return err
+		}
 	}
 	
-	return &Message{toAddr, replyAddr, timeout, body, 0}, nil
+	return nil
 }
 
 func (stream *CommandStream) WriteCommand(command []string) os.Error {
@@ -95,53 +350,66 @@ func (stream *CommandStream) WriteMessage(msg *Message) os.Error {
 		err := stream.WriteCommand([]string{timeoutCommandStr})
 		return err
 	}
-
-	command := make([]string, 5)
-	command[0] = messageCommandStr
-	command[1] = strconv.Itoa(len(msg.Body))
-	command[2] = strconv.Itoa64(msg.TimeoutSeconds)
-	command[3] = msg.ToAddress
+	
+	command := []string{messageCommandStr, strconv.Itoa(len(msg.Body)), FormatMillis(msg.TimeoutMillis), msg.ToAddress}
 	
 	if msg.ReplyAddress != "" {
-		command[4] = msg.ReplyAddress
-	} else {
-		command = command[0:4]
+		command = appendString(command, msg.ReplyAddress)
 	}
 	
-	err := stream.WriteCommand(command)
+	return stream.writeMessageCommand(command, msg)
+}
+
+// WriteQuery writes a query for msg. Its reply address is ignored, since
+// the server generates one for each query.
+func (stream *CommandStream) WriteQuery(msg *Message) os.Error {
+	command := []string{queryCommandStr, strconv.Itoa(len(msg.Body)), FormatMillis(msg.TimeoutMillis), msg.ToAddress}
+	return stream.writeMessageCommand(command, msg)
+}
+
+// WriteStreamQuery writes a query for msg whose replies are streamed back
+// until one is marked EndOfStream.
+func (stream *CommandStream) WriteStreamQuery(msg *Message) os.Error {
+	command := []string{queryCommandStr, strconv.Itoa(len(msg.Body)), FormatMillis(msg.TimeoutMillis), msg.ToAddress, streamOptionStr + "=1"}
+	return stream.writeMessageCommand(command, msg)
+}
+
+// WriteGatherQuery writes a query for msg to each of toAddresses, whose
+// replies are gathered until quorum of them arrive, or all of them if
+// quorum is zero. msg's own address is ignored.
+func (stream *CommandStream) WriteGatherQuery(msg *Message, toAddresses []string, quorum int) os.Error {
+	command := []string{queryCommandStr, strconv.Itoa(len(msg.Body)), FormatMillis(msg.TimeoutMillis)}
+	for _, toAddress := range toAddresses {
+		command = appendString(command, toAddress)
+	}
+	command = appendString(command, quorumOptionStr + "=" + strconv.Itoa(quorum))
+	return stream.writeMessageCommand(command, msg)
+}
+
+func (stream *CommandStream) writeMessageCommand(command []string, msg *Message) os.Error {
+	// a bad header would corrupt the stream, so it has to be caught before
+	// anything is written
+	err := checkHeaders(msg.Headers)
 	if err != nil {
 		return err
 	}
 	
-	if len(msg.Body) > 0 {
-		_, err = io.WriteString(stream.writer, msg.Body)
-		if err != nil {
-			return err
-		}
-		
-		_, err = io.WriteString(stream.writer, "\r\n")
-		if err != nil {
-			return err
-		}
+	for _, option := range messageOptions(msg) {
+		command = appendString(command, option)
 	}
 	
-	return nil
-}
-
-func (stream *CommandStream) WriteQuery(body string, timeoutSeconds int64, toAddress string) os.Error {
-	command := make([]string, 4)
-	command[0] = queryCommandStr
-	command[1] = strconv.Itoa(len(body))
-	command[2] = strconv.Itoa64(timeoutSeconds)
-	command[3] = toAddress
-		
-	err := stream.WriteCommand(command)
+	err = stream.WriteCommand(command)
 	if err != nil {
 		return err
 	}
 	
-	if len(body) > 0 {
-		_, err = io.WriteString(stream.writer, body)
+	err = stream.writeHeaders(msg.Headers)
+	if err != nil {
+		return err
+	}
+	
+	if len(msg.Body) > 0 {
+		_, err = stream.writer.Write(msg.Body)
 		if err != nil {
 			return err
 		}
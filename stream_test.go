@@ -0,0 +1,87 @@
+// Copyright (c) 2010 William R. Conant, WillConant.com
+// Use of this source code is governed by the MIT licence:
+// http://www.opensource.org/licenses/mit-license.php
+
+package msglite
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"testing"
+)
+
+// bufferCloser lets a bytes.Buffer stand in for a connection.
+type bufferCloser struct {
+	*bytes.Buffer
+}
+
+func (buffer bufferCloser) Close() os.Error {
+	return nil
+}
+
+func newBufferStream() *CommandStream {
+	buffer := new(bytes.Buffer)
+	return &CommandStream{bufio.NewReader(buffer), bufferCloser{buffer}, false}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	sent := []*Message{
+		&Message{ToAddress: "a", ReplyAddress: "b", TimeoutMillis: 1500, Body: []byte("line one\r\nline two\r\n")},
+		&Message{ToAddress: "a", TimeoutMillis: 0, Body: []byte("nul\x00in the middle")},
+		&Message{ToAddress: "a", TimeoutMillis: 250, Body: []byte("trailing\r")},
+		&Message{ToAddress: "a", ReplyAddress: "b", TimeoutMillis: 1000, Body: []byte{}},
+	}
+
+	stream := newBufferStream()
+	for _, msg := range sent {
+		err := stream.WriteMessage(msg)
+		if err != nil {
+			t.Fatalf("writing %q: %v", msg.Body, err.String())
+		}
+	}
+
+	for _, msg := range sent {
+		received, err := stream.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading %q: %v", msg.Body, err.String())
+		}
+		if received == nil {
+			t.Fatalf("reading %q: got a timeout", msg.Body)
+		}
+
+		if received.ToAddress != msg.ToAddress || received.ReplyAddress != msg.ReplyAddress || received.TimeoutMillis != msg.TimeoutMillis {
+			t.Errorf("sent %v %v %v, received %v %v %v", msg.ToAddress, msg.ReplyAddress, msg.TimeoutMillis, received.ToAddress, received.ReplyAddress, received.TimeoutMillis)
+		}
+		if !bytes.Equal(received.Body, msg.Body) {
+			t.Errorf("sent body %q, received %q", msg.Body, received.Body)
+		}
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	headers := map[string]string{"padded": "  both ends  ", "empty": "", "colon": "a: b"}
+
+	stream := newBufferStream()
+	err := stream.WriteMessage(&Message{ToAddress: "a", TimeoutMillis: 1000, Headers: headers, Body: []byte("body")})
+	if err != nil {
+		t.Fatalf("writing: %v", err.String())
+	}
+
+	received, err := stream.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading: %v", err.String())
+	}
+	if received == nil {
+		t.Fatalf("reading: got a timeout")
+	}
+
+	if len(received.Headers) != len(headers) {
+		t.Errorf("sent %v headers, received %v", len(headers), len(received.Headers))
+	}
+	for key, value := range headers {
+		if received.Headers[key] != value {
+			t.Errorf("sent header %v as %q, received %q", key, value, received.Headers[key])
+		}
+	}
+}